@@ -0,0 +1,191 @@
+package config
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// crlCheckInterval is how often the CRL files are looked at for changes.
+var crlCheckInterval = time.Second
+
+// revocationList holds the CRLs from a set of local files. The files are
+// re-read every crlCheckInterval and parsed again when their contents
+// change, so a new CRL takes effect without a restart. Contents are
+// compared rather than modification times, which can miss a rewrite
+// within the filesystem's timestamp granularity.
+type revocationList struct {
+	files []string
+
+	mu      sync.Mutex
+	checked time.Time
+	raw     map[string][]byte
+	crls    []*loadedCRL
+}
+
+// loadedCRL is a parsed CRL with its revoked serials in a set.
+type loadedCRL struct {
+	*x509.RevocationList
+	revoked map[string]bool
+	// signed caches whether the CRL's signature checks out against an
+	// issuer, by the issuer's DER.
+	signed map[string]bool
+}
+
+func newLoadedCRL(crl *x509.RevocationList) *loadedCRL {
+	l := &loadedCRL{
+		RevocationList: crl,
+		revoked:        make(map[string]bool, len(crl.RevokedCertificateEntries)),
+		signed:         make(map[string]bool),
+	}
+	for _, e := range crl.RevokedCertificateEntries {
+		l.revoked[e.SerialNumber.String()] = true
+	}
+	return l
+}
+
+// signedBy reports whether issuer signed the CRL, checking the signature
+// once per issuer. Callers hold revocationList.mu.
+func (l *loadedCRL) signedBy(issuer *x509.Certificate) bool {
+	ok, checked := l.signed[string(issuer.Raw)]
+	if !checked {
+		ok = bytes.Equal(l.RawIssuer, issuer.RawSubject) && l.CheckSignatureFrom(issuer) == nil
+		l.signed[string(issuer.Raw)] = ok
+	}
+	return ok
+}
+
+func newRevocationList(files []string) (*revocationList, error) {
+	r := &revocationList{files: files}
+	if err := r.refresh(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *revocationList) refresh() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.raw != nil && now.Sub(r.checked) < crlCheckInterval {
+		return nil
+	}
+	r.checked = now
+	raw := make(map[string][]byte, len(r.files))
+	changed := r.raw == nil
+	for _, f := range r.files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		raw[f] = b
+		if !bytes.Equal(b, r.raw[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	var crls []*loadedCRL
+	for _, f := range r.files {
+		parsed, err := parseCRLs(raw[f])
+		if err != nil {
+			return fmt.Errorf("failed to parse CRL %q: %w", f, err)
+		}
+		for _, crl := range parsed {
+			crls = append(crls, newLoadedCRL(crl))
+		}
+	}
+	r.raw = raw
+	r.crls = crls
+	return nil
+}
+
+// NewRevocationChecker returns a check of verified chains against the
+// CRLs in files, re-read when they change, for servers that also check
+// revocation on every request: the handshake check only covers new
+// connections. A change takes up to a second to be noticed.
+func NewRevocationChecker(files ...string) (func(chains [][]*x509.Certificate) error, error) {
+	r, err := newRevocationList(files)
+	if err != nil {
+		return nil, err
+	}
+	return func(chains [][]*x509.Certificate) error {
+		return r.verify(nil, chains)
+	}, nil
+}
+
+// parseCRLs accepts one DER encoded CRL or any number of PEM "X509 CRL"
+// blocks.
+func parseCRLs(b []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("no X509 CRL block found")
+	}
+	return crls, nil
+}
+
+// verify is used as tls.Config.VerifyPeerCertificate. It rejects the peer
+// if any certificate in its verified chain was revoked by a CRL signed by
+// that certificate's issuer, or if that CRL is past its NextUpdate, as a
+// stale CRL may be missing revocations.
+func (r *revocationList) verify(_ [][]byte, chains [][]*x509.Certificate) error {
+	// On a read error the CRLs already loaded stay in use rather than
+	// rejecting everyone while a file is being replaced.
+	r.refresh()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, crl := range r.crls {
+				if !crl.signedBy(issuer) {
+					continue
+				}
+				if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+					return fmt.Errorf(
+						"CRL of %q is stale since %s",
+						issuer.Subject.CommonName,
+						crl.NextUpdate.Format(time.RFC3339),
+					)
+				}
+				if crl.revoked[cert.SerialNumber.String()] {
+					return fmt.Errorf(
+						"certificate %q (serial %s) has been revoked",
+						cert.Subject.CommonName,
+						cert.SerialNumber,
+					)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var crlNumber int64
+
+// revoke writes a CRL to path revoking the given certificates.
+func (ca *testCA) revoke(t *testing.T, path string, certs ...*x509.Certificate) {
+	t.Helper()
+	ca.revokeUntil(t, path, time.Now().Add(time.Hour), certs...)
+}
+
+// revokeUntil is revoke with the CRL's next update at nextUpdate.
+func (ca *testCA) revokeUntil(t *testing.T, path string, nextUpdate time.Time, certs ...*x509.Certificate) {
+	t.Helper()
+	crlNumber++
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(crlNumber),
+		ThisUpdate: nextUpdate.Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, c := range certs {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{
+				SerialNumber:   c.SerialNumber,
+				RevocationTime: time.Now(),
+			})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	require.NoError(t, err)
+	writeFile(t, path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+}
+
+// noCRLCheckInterval has CRL changes noticed right away.
+func noCRLCheckInterval(t *testing.T) {
+	interval := crlCheckInterval
+	crlCheckInterval = 0
+	t.Cleanup(func() { crlCheckInterval = interval })
+}
+
+func TestRevocation(t *testing.T) {
+	noCRLCheckInterval(t)
+	dir := t.TempDir()
+	ca := newTestCA(t, "CA")
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem)
+	ca.issue(t, dir, "server", "127.0.0.1", true)
+	root := ca.issue(t, dir, "root-client", "root", false)
+	ca.issue(t, dir, "nobody-client", "nobody", false)
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.revoke(t, crlFile)
+
+	// Another CA's CRL naming the same serial must not revoke anything.
+	other := newTestCA(t, "CA")
+	otherCRL := filepath.Join(dir, "other.crl")
+	other.revoke(t, otherCRL, root)
+
+	serverTLS, err := SetupTLSConfig(TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+		CRLFiles: []string{crlFile, otherCRL},
+	})
+	require.NoError(t, err)
+	client := func(name string) (*x509.Certificate, error) {
+		clientTLS, err := SetupTLSConfig(TLSConfig{
+			CertFile: filepath.Join(dir, name+".pem"),
+			KeyFile:  filepath.Join(dir, name+"-key.pem"),
+			CAFile:   filepath.Join(dir, "ca.pem"),
+		})
+		require.NoError(t, err)
+		return handshake(t, serverTLS, clientTLS)
+	}
+
+	_, err = client("root-client")
+	require.NoError(t, err)
+
+	ca.revoke(t, crlFile, root)
+	_, err = client("root-client")
+	require.Error(t, err)
+	_, err = client("nobody-client")
+	require.NoError(t, err)
+
+	// A CRL that fails to parse keeps the last good one in force.
+	writeFile(t, crlFile, []byte("-----BEGIN X509 CRL-----\ngarbage\n"))
+	_, err = client("root-client")
+	require.Error(t, err)
+
+	// So does a CRL past its next update, until a fresh one replaces it.
+	ca.revokeUntil(t, crlFile, time.Now().Add(-time.Second))
+	_, err = client("nobody-client")
+	require.Error(t, err)
+	ca.revoke(t, crlFile)
+	_, err = client("nobody-client")
+	require.NoError(t, err)
+
+	_, err = SetupTLSConfig(TLSConfig{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+		CRLFiles: []string{filepath.Join(dir, "missing.crl")},
+	})
+	require.Error(t, err)
+}
+
+func TestRevocationCheckInterval(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "CA")
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.revoke(t, crlFile)
+	r, err := newRevocationList([]string{crlFile})
+	require.NoError(t, err)
+	cert := ca.issue(t, dir, "nobody-client", "nobody", false)
+	chains := [][]*x509.Certificate{{cert, ca.cert}}
+	require.NoError(t, r.verify(nil, chains))
+
+	// The files aren't looked at again until the interval is up.
+	ca.revoke(t, crlFile, cert)
+	require.NoError(t, r.verify(nil, chains))
+	r.mu.Lock()
+	r.checked = time.Time{}
+	r.mu.Unlock()
+	require.ErrorContains(t, r.verify(nil, chains), "revoked")
+
+	ca.revokeUntil(t, crlFile, time.Now().Add(-time.Second))
+	r.mu.Lock()
+	r.checked = time.Time{}
+	r.mu.Unlock()
+	require.ErrorContains(t, r.verify(nil, chains), "stale")
+}
@@ -25,7 +25,5 @@ func configFile(filename string) string {
 	if err != nil {
 		panic(err)
 	}
-
-	// modify this
-	return filepath.Join(homeDir, "0241911_SistemasDistribuidos", "TLS_Proyecto", "CA", filename)
+	return filepath.Join(homeDir, ".proyecto", filename)
 }
@@ -0,0 +1,255 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CertReloader keeps the certificate, key and CA bundle named in a
+// TLSConfig in memory and reloads them when the files change, so certs can
+// be rotated without restarting. To roll over to a new CA, first ship a
+// CA file holding both the old and the new CA certificates, then reissue
+// the leaf certificates, then drop the old CA from the bundle.
+type CertReloader struct {
+	cfg TLSConfig
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	ca     *x509.CertPool
+	expiry map[string]time.Time
+
+	crls     *revocationList
+	watcher  *fsnotify.Watcher
+	failures prometheus.Counter
+}
+
+func NewCertReloader(cfg TLSConfig) (*CertReloader, error) {
+	r := &CertReloader{
+		cfg: cfg,
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tls_reload_failures_total",
+			Help: "Certificate reloads that failed and kept the previous files.",
+		}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if len(cfg.CRLFiles) > 0 {
+		var err error
+		if r.crls, err = newRevocationList(cfg.CRLFiles); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the previously loaded
+// certificates stay in use.
+func (r *CertReloader) Reload() error {
+	var cert *tls.Certificate
+	expiry := make(map[string]time.Time)
+	if r.cfg.CertFile != "" && r.cfg.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+			return err
+		}
+		cert = &c
+		expiry[r.cfg.CertFile] = c.Leaf.NotAfter
+	}
+	var ca *x509.CertPool
+	if r.cfg.CAFile != "" {
+		b, err := os.ReadFile(r.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		ca = x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return fmt.Errorf("failed to parse root certificate: %q", r.cfg.CAFile)
+		}
+		if notAfter, ok := earliestExpiry(b); ok {
+			expiry[r.cfg.CAFile] = notAfter
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = cert
+	r.ca = ca
+	r.expiry = expiry
+	return nil
+}
+
+func earliestExpiry(b []byte) (time.Time, bool) {
+	var earliest time.Time
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if earliest.IsZero() || c.NotAfter.Before(earliest) {
+			earliest = c.NotAfter
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// Watch reloads the files whenever their directories change. Directories
+// are watched rather than files because Kubernetes updates mounted secrets
+// by swapping a symlink.
+func (r *CertReloader) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, f := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if f != "" {
+			dirs[filepath.Dir(f)] = true
+		}
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	r.watcher = w
+	go func() {
+		for {
+			select {
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// Cert and key are usually written one after the other,
+				// so a reload can briefly see a mismatched pair; the
+				// next event fixes it.
+				if err := r.Reload(); err != nil {
+					r.failures.Inc()
+				}
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *CertReloader) Close() error {
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Close()
+}
+
+func (r *CertReloader) certificate() (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("no certificate configured")
+	}
+	return r.cert, nil
+}
+
+func (r *CertReloader) pool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ca
+}
+
+// TLSConfig returns a config that always uses the latest loaded files.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	if r.cfg.Server {
+		return &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				cert, err := r.certificate()
+				if err != nil {
+					return nil, err
+				}
+				c := &tls.Config{Certificates: []tls.Certificate{*cert}}
+				if ca := r.pool(); ca != nil {
+					c.ClientCAs = ca
+					c.ClientAuth = r.cfg.clientAuth()
+				}
+				if r.crls != nil {
+					c.VerifyPeerCertificate = r.crls.verify
+				}
+				return c, nil
+			},
+		}
+	}
+	c := &tls.Config{
+		ServerName: r.cfg.ServerAddress,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate()
+		},
+	}
+	if r.pool() != nil {
+		// RootCAs cannot be swapped on a live config, so the default
+		// verification is replaced by one against the current pool.
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = r.verifyServer
+	}
+	return c
+}
+
+func (r *CertReloader) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         r.pool(),
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil || r.crls == nil {
+		return err
+	}
+	return r.crls.verify(nil, chains)
+}
+
+var expiryDesc = prometheus.NewDesc(
+	"tls_certificate_expiry_timestamp_seconds",
+	"NotAfter of the loaded certificate, or of the first CA to expire in a bundle.",
+	[]string{"file"}, nil,
+)
+
+func (r *CertReloader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- expiryDesc
+	r.failures.Describe(ch)
+}
+
+func (r *CertReloader) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	for file, notAfter := range r.expiry {
+		ch <- prometheus.MustNewConstMetric(
+			expiryDesc, prometheus.GaugeValue, float64(notAfter.Unix()), file,
+		)
+	}
+	r.mu.RUnlock()
+	r.failures.Collect(ch)
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue writes a leaf certificate signed by ca to dir/name.pem and
+// dir/name-key.pem.
+func (ca *testCA) issue(t *testing.T, dir, name, cn string, server bool) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	writeFile(t, filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, filepath.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+// writeFile replaces path atomically so watchers never see a partial file.
+func writeFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, b, 0600))
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func handshake(t *testing.T, server, client *tls.Config) (*x509.Certificate, error) {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	client = client.Clone()
+	client.ServerName = "127.0.0.1"
+	conn, err := tls.Dial("tcp", l.Addr().String(), client)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// TLS 1.3 clients learn about a rejected certificate on first read.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	oldCA := newTestCA(t, "old CA")
+	writeFile(t, filepath.Join(dir, "ca.pem"), oldCA.pem)
+	oldServer := oldCA.issue(t, dir, "server", "127.0.0.1", true)
+	oldCA.issue(t, dir, "client", "root", false)
+
+	serverReloader, err := NewCertReloader(TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, serverReloader.Watch())
+	defer serverReloader.Close()
+	clientReloader, err := NewCertReloader(TLSConfig{
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	})
+	require.NoError(t, err)
+	serverTLS := serverReloader.TLSConfig()
+	clientTLS := clientReloader.TLSConfig()
+
+	got, err := handshake(t, serverTLS, clientTLS)
+	require.NoError(t, err)
+	require.Equal(t, oldServer.SerialNumber, got.SerialNumber)
+
+	// Overlap: trust both CAs, then move the server to the new one while
+	// the client still holds a certificate from the old one.
+	newCA := newTestCA(t, "new CA")
+	writeFile(t, filepath.Join(dir, "ca.pem"), append(oldCA.pem, newCA.pem...))
+	newServer := newCA.issue(t, dir, "server", "127.0.0.1", true)
+	require.NoError(t, clientReloader.Reload())
+	require.Eventually(t, func() bool {
+		got, err := handshake(t, serverTLS, clientTLS)
+		return err == nil && got.SerialNumber.Cmp(newServer.SerialNumber) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Dropping the old CA rejects clients that were not reissued.
+	writeFile(t, filepath.Join(dir, "ca.pem"), newCA.pem)
+	require.Eventually(t, func() bool {
+		_, err := handshake(t, serverTLS, clientTLS)
+		return err != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	newCA.issue(t, dir, "client", "root", false)
+	require.NoError(t, clientReloader.Reload())
+	_, err = handshake(t, serverTLS, clientTLS)
+	require.NoError(t, err)
+
+	// A broken file keeps the previous certificates in use.
+	writeFile(t, filepath.Join(dir, "server.pem"), []byte("garbage"))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(serverReloader.failures) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = handshake(t, serverTLS, clientTLS)
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(serverReloader))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	expiry := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "tls_certificate_expiry_timestamp_seconds" {
+			continue
+		}
+		for _, m := range f.Metric {
+			expiry[m.Label[0].GetValue()] = m.Gauge.GetValue()
+		}
+	}
+	require.Equal(t,
+		float64(newServer.NotAfter.Unix()),
+		expiry[filepath.Join(dir, "server.pem")],
+	)
+	require.Equal(t,
+		float64(newCA.cert.NotAfter.Unix()),
+		expiry[filepath.Join(dir, "ca.pem")],
+	)
+}
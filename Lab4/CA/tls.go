@@ -29,12 +29,19 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		}
 		if cfg.Server {
 			tlsConfig.ClientCAs = ca
-			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConfig.ClientAuth = cfg.clientAuth()
 		} else {
 			tlsConfig.RootCAs = ca
 		}
 		tlsConfig.ServerName = cfg.ServerAddress
 	}
+	if len(cfg.CRLFiles) > 0 {
+		crls, err := newRevocationList(cfg.CRLFiles)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = crls.verify
+	}
 	return tlsConfig, nil
 }
 
@@ -44,4 +51,18 @@ type TLSConfig struct {
 	CAFile        string
 	ServerAddress string
 	Server        bool
+	// CRLFiles are checked against the peer's verified chain on every
+	// handshake and re-read when they change.
+	CRLFiles []string
+	// OptionalClientCert lets clients without a certificate finish the
+	// handshake, for listeners that also accept bearer tokens. Presented
+	// certificates are still verified.
+	OptionalClientCert bool
+}
+
+func (cfg TLSConfig) clientAuth() tls.ClientAuthType {
+	if cfg.OptionalClientCert {
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.RequireAndVerifyClientCert
 }
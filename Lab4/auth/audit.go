@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	api "Proyecto/api/v1"
+)
+
+// AuditLog is where audit entries are stored, normally a Log opened on a
+// directory of its own so it is never mixed with user records. A log
+// with a LowestOffset method is replayed from there, so it may be
+// truncated.
+type AuditLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+}
+
+type authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+// AuditEntry records one authorization decision. Each entry carries the
+// hash of the previous one, so editing or removing an entry breaks the
+// chain for every entry after it.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Subject string    `json:"subject"`
+	Groups  []string  `json:"groups,omitempty"`
+	Object  string    `json:"object"`
+	Action  string    `json:"action"`
+	Allowed bool      `json:"allowed"`
+	Prev    string    `json:"prev"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+func (e AuditEntry) sum() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+var ErrAuditTampered = errors.New("audit trail has been tampered with")
+
+// auditHead is what an Auditor's head file holds: the last entry it
+// appended.
+type auditHead struct {
+	Offset uint64 `json:"offset"`
+	Hash   string `json:"hash"`
+}
+
+// Auditor wraps an authorizer and appends every decision it makes,
+// allowed or denied, to an AuditLog.
+type Auditor struct {
+	authorizer authorizer
+	log        AuditLog
+	headFile   string
+
+	mu   sync.Mutex
+	prev string
+}
+
+// NewAuditor verifies the entries already in log and continues the chain
+// from the last one. When headFile isn't empty, the last entry appended
+// is kept in it, outside the log, so that entries cut off the end of the
+// log are detected too.
+func NewAuditor(a authorizer, log AuditLog, headFile string) (*Auditor, error) {
+	au := &Auditor{
+		authorizer: a,
+		log:        log,
+		headFile:   headFile,
+	}
+	err := au.Replay(func(_ uint64, e AuditEntry) error {
+		au.prev = e.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return au, nil
+}
+
+func (a *Auditor) Authorize(subject, object, action string) error {
+	return a.AuthorizeIdentity(Identity{Subject: subject}, object, action)
+}
+
+// AuthorizeIdentity passes the groups on when the wrapped authorizer
+// understands them.
+func (a *Auditor) AuthorizeIdentity(id Identity, object, action string) error {
+	var err error
+	if ia, ok := a.authorizer.(interface {
+		AuthorizeIdentity(Identity, string, string) error
+	}); ok {
+		err = ia.AuthorizeIdentity(id, object, action)
+	} else {
+		err = a.authorizer.Authorize(id.Subject, object, action)
+	}
+	if aerr := a.record(id, object, action, err == nil); aerr != nil {
+		return aerr
+	}
+	return err
+}
+
+// Roles returns the wrapped authorizer's roles for subject, if it has any.
+func (a *Auditor) Roles(subject string) []string {
+	if r, ok := a.authorizer.(interface{ Roles(string) []string }); ok {
+		return r.Roles(subject)
+	}
+	return nil
+}
+
+func (a *Auditor) record(id Identity, object, action string, allowed bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := AuditEntry{
+		Time:    time.Now().UTC(),
+		Subject: id.Subject,
+		Groups:  id.Groups,
+		Object:  object,
+		Action:  action,
+		Allowed: allowed,
+		Prev:    a.prev,
+	}
+	var err error
+	if e.Hash, err = e.sum(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	off, err := a.log.Append(&api.Record{Value: b})
+	if err != nil {
+		return err
+	}
+	a.prev = e.Hash
+	if a.headFile == "" {
+		return nil
+	}
+	return a.writeHead(auditHead{Offset: off, Hash: e.Hash})
+}
+
+func (a *Auditor) writeHead(head auditHead) error {
+	b, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	tmp := a.headFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.headFile)
+}
+
+// readHead returns nil before the first entry is appended.
+func (a *Auditor) readHead() (*auditHead, error) {
+	if a.headFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(a.headFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	head := &auditHead{}
+	if err := json.Unmarshal(b, head); err != nil {
+		return nil, fmt.Errorf("%s: %w", a.headFile, err)
+	}
+	return head, nil
+}
+
+// Replay calls fn for every entry in order, returning ErrAuditTampered as
+// soon as an entry does not match its hash or the one before it, or when
+// the log ends before the last entry in the head file. The first entry of
+// a truncated log is taken as is, since the one before it is gone.
+func (a *Auditor) Replay(fn func(off uint64, e AuditEntry) error) error {
+	head, err := a.readHead()
+	if err != nil {
+		return err
+	}
+	var start uint64
+	if l, ok := a.log.(interface{ LowestOffset() (uint64, error) }); ok {
+		if start, err = l.LowestOffset(); err != nil {
+			return err
+		}
+	}
+	var prev string
+	for off := start; ; off++ {
+		record, err := a.log.Read(off)
+		if err != nil {
+			var outOfRange api.ErrOffsetOutOfRange
+			if !errors.As(err, &outOfRange) {
+				return err
+			}
+			if head != nil && head.Offset >= off {
+				return fmt.Errorf("%w: log ends at offset %d, before the last entry at %d", ErrAuditTampered, off, head.Offset)
+			}
+			return nil
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(record.Value, &e); err != nil {
+			return fmt.Errorf("%w: offset %d: %v", ErrAuditTampered, off, err)
+		}
+		sum, err := e.sum()
+		if err != nil {
+			return err
+		}
+		if (off > start || start == 0) && e.Prev != prev || e.Hash != sum {
+			return fmt.Errorf("%w: offset %d", ErrAuditTampered, off)
+		}
+		if head != nil && off == head.Offset && e.Hash != head.Hash {
+			return fmt.Errorf("%w: offset %d isn't the last entry appended", ErrAuditTampered, off)
+		}
+		if err := fn(off, e); err != nil {
+			return err
+		}
+		prev = e.Hash
+	}
+}
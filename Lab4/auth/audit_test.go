@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	api "Proyecto/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memLog keeps records from lowest on.
+type memLog struct {
+	records []*api.Record
+	lowest  uint64
+}
+
+func (l *memLog) Append(record *api.Record) (uint64, error) {
+	l.records = append(l.records, record)
+	return uint64(len(l.records) - 1), nil
+}
+
+func (l *memLog) Read(off uint64) (*api.Record, error) {
+	if off < l.lowest || off >= uint64(len(l.records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return l.records[off], nil
+}
+
+func (l *memLog) LowestOffset() (uint64, error) {
+	return l.lowest, nil
+}
+
+type onlyRoot struct{}
+
+func (onlyRoot) Authorize(subject, object, action string) error {
+	if subject != "root" {
+		return status.Error(codes.PermissionDenied, "denied")
+	}
+	return nil
+}
+
+func TestAuditor(t *testing.T) {
+	l := &memLog{}
+	a, err := NewAuditor(onlyRoot{}, l, "")
+	require.NoError(t, err)
+	require.NoError(t, a.Authorize("root", "*", "produce"))
+	require.Error(t, a.Authorize("nobody", "*", "consume"))
+	require.NoError(t, a.Authorize("root", "*", "consume"))
+
+	// Reopening continues the chain from the last entry.
+	a, err = NewAuditor(onlyRoot{}, l, "")
+	require.NoError(t, err)
+	require.NoError(t, a.Authorize("root", "*", "produce"))
+	var n int
+	require.NoError(t, a.Replay(func(_ uint64, e AuditEntry) error {
+		n++
+		return nil
+	}))
+	require.Equal(t, 4, n)
+
+	// Rewriting a denial as allowed breaks the chain.
+	var e AuditEntry
+	require.NoError(t, json.Unmarshal(l.records[1].Value, &e))
+	e.Allowed = true
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+	l.records[1] = &api.Record{Value: b}
+	err = a.Replay(func(uint64, AuditEntry) error { return nil })
+	require.True(t, errors.Is(err, ErrAuditTampered))
+	_, err = NewAuditor(onlyRoot{}, l, "")
+	require.True(t, errors.Is(err, ErrAuditTampered))
+}
+
+func TestAuditorTruncated(t *testing.T) {
+	l := &memLog{}
+	head := filepath.Join(t.TempDir(), "audit-head")
+	a, err := NewAuditor(onlyRoot{}, l, head)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, a.Authorize("root", "*", "produce"))
+	}
+
+	// Dropping the oldest entries leaves a chain that still checks out.
+	l.lowest = 2
+	var offsets []uint64
+	a, err = NewAuditor(onlyRoot{}, l, head)
+	require.NoError(t, err)
+	require.NoError(t, a.Replay(func(off uint64, _ AuditEntry) error {
+		offsets = append(offsets, off)
+		return nil
+	}))
+	require.Equal(t, []uint64{2, 3}, offsets)
+
+	// Dropping the newest is caught with the head file, and not without.
+	l.records = l.records[:3]
+	_, err = NewAuditor(onlyRoot{}, l, head)
+	require.ErrorIs(t, err, ErrAuditTampered)
+	_, err = NewAuditor(onlyRoot{}, l, "")
+	require.NoError(t, err)
+}
@@ -1,34 +1,157 @@
 package auth
 
 import (
+	_ "embed"
 	"fmt"
+	"path"
+	"sync"
 
 	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/model"
+	"github.com/fsnotify/fsnotify"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func New(model, policy string) *Authorizer {
-	enforcer := casbin.NewEnforcer(model, policy)
-	return &Authorizer{
-		enforcer: enforcer,
+// The default ACL is role based: policies grant actions on object
+// patterns to roles, and "g" rules put subjects (or other roles) in them.
+//
+//go:embed model.conf
+var defaultModel string
+
+//go:embed policy.csv
+var defaultPolicy string
+
+// NewAuthorizer loads the ACL model and policy from the given files. An
+// empty path selects the embedded default.
+func NewAuthorizer(modelFile, policyFile string) (*Authorizer, error) {
+	a := &Authorizer{
+		modelFile: modelFile,
+		adapter:   &policyAdapter{path: policyFile},
+	}
+	var err error
+	if a.enforcer, a.deny, err = a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// New is NewAuthorizer for tests and tools that would rather not fail: a
+// policy file that can't be read leaves the ACL empty, denying
+// everything, until a Reload succeeds. It panics if the model can't be
+// loaded.
+func New(modelFile, policyFile string) *Authorizer {
+	a := &Authorizer{
+		modelFile: modelFile,
+		adapter:   &policyAdapter{path: policyFile},
+	}
+	var err error
+	if a.enforcer, a.deny, err = a.load(); a.enforcer == nil {
+		panic(err)
+	}
+	return a
+}
+
+// load builds a fresh pair of enforcers from the model and policy. The
+// enforcers are nil if the model can't be loaded, and empty if the policy
+// can't.
+func (a *Authorizer) load() (enforcer, deny *casbin.Enforcer, err error) {
+	// casbin panics on a model it can't read or parse.
+	defer func() {
+		if r := recover(); r != nil {
+			enforcer, deny = nil, nil
+			err = fmt.Errorf("failed to load ACL model %q: %v", a.modelFile, r)
+		}
+	}()
+	var m model.Model
+	if a.modelFile == "" {
+		m = casbin.NewModel(defaultModel)
+	} else {
+		m = casbin.NewModel(a.modelFile, "")
+	}
+	enforcer = casbin.NewEnforcer(m)
+	enforcer.SetAdapter(a.adapter)
+	// Changes are written out whole by SavePolicy.
+	enforcer.EnableAutoSave(false)
+	err = enforcer.LoadPolicy()
+	deny = casbin.NewEnforcer(denyOnly(m))
+	for _, e := range []*casbin.Enforcer{enforcer, deny} {
+		e.AddFunction("globMatch", globMatchFunc)
+	}
+	return enforcer, deny, err
+}
+
+// denyOnly returns a view of m sharing its policy and roles whose effect
+// only looks at deny rules, so a deny for one of an identity's principals
+// can be found even when another principal is allowed.
+func denyOnly(m model.Model) model.Model {
+	view := make(model.Model, len(m))
+	for sec, assertions := range m {
+		view[sec] = assertions
 	}
+	view["e"] = model.AssertionMap{"e": &model.Assertion{
+		Key:   "e",
+		Value: "!some(where (p_eft == deny))",
+	}}
+	return view
+}
+
+// globMatchFunc matches the request object against a shell pattern such
+// as "topics/orders-*". A malformed pattern matches nothing: casbin panics
+// on an error from a function.
+func globMatchFunc(args ...interface{}) (interface{}, error) {
+	name, _ := args[0].(string)
+	pattern, _ := args[1].(string)
+	matched, _ := path.Match(pattern, name)
+	return matched, nil
 }
 
 type Authorizer struct {
+	modelFile string
+	adapter   *policyAdapter
+
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
+	deny     *casbin.Enforcer
+
+	watcher *fsnotify.Watcher
+}
+
+// Identity is an authenticated client: its subject and the groups it
+// belongs to, taken from the certificate's OU.
+type Identity struct {
+	Subject string
+	Groups  []string
 }
 
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
-		msg := fmt.Sprintf(
-			"%s not permitted to %s to %s",
-			subject,
-			action,
-			object,
-		)
-		st := status.New(codes.PermissionDenied, msg)
-		return st.Err()
-	}
-	return nil
+	return a.AuthorizeIdentity(Identity{Subject: subject}, object, action)
+}
+
+// AuthorizeIdentity permits the request if the policy allows the subject
+// or any of its groups, and denies none of them.
+func (a *Authorizer) AuthorizeIdentity(id Identity, object, action string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	allowed := false
+	for _, principal := range append([]string{id.Subject}, id.Groups...) {
+		if !a.deny.Enforce(principal, object, action) {
+			allowed = false
+			break
+		}
+		if a.enforcer.Enforce(principal, object, action) {
+			allowed = true
+		}
+	}
+	if allowed {
+		return nil
+	}
+	msg := fmt.Sprintf(
+		"%s not permitted to %s to %s",
+		id.Subject,
+		action,
+		object,
+	)
+	st := status.New(codes.PermissionDenied, msg)
+	return st.Err()
 }
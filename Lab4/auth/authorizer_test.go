@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func writePolicy(t *testing.T, lines ...string) string {
+	t.Helper()
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(policy, []byte(strings.Join(lines, "\n")), 0644))
+	return policy
+}
+
+func TestAuthorizeIdentity(t *testing.T) {
+	// Rules without an effect column predate deny rules and still allow.
+	policy := writePolicy(t,
+		"p, root, *, produce",
+		"p, Distributed Services, *, consume",
+	)
+	a := New("", policy)
+
+	require.NoError(t, a.Authorize("root", "*", "produce"))
+	require.Error(t, a.Authorize("alice", "*", "consume"))
+	require.NoError(t, a.AuthorizeIdentity(Identity{
+		Subject: "alice",
+		Groups:  []string{"Distributed Services"},
+	}, "*", "consume"))
+	require.Error(t, a.AuthorizeIdentity(Identity{
+		Subject: "alice",
+		Groups:  []string{"Distributed Services"},
+	}, "*", "produce"))
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	_, err := NewAuthorizer("", writePolicy(t, "p, root, *, produce"))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for name, files := range map[string][2]string{
+		"missing policy":   {"", filepath.Join(dir, "missing.csv")},
+		"malformed policy": {"", writePolicy(t, "p, root")},
+		"missing model":    {filepath.Join(dir, "missing.conf"), ""},
+	} {
+		_, err := NewAuthorizer(files[0], files[1])
+		require.Error(t, err, name)
+	}
+	require.Panics(t, func() { New(filepath.Join(dir, "missing.conf"), "") })
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	a := New("", "")
+	require.NoError(t, a.Authorize("root", "*", "produce"))
+	require.NoError(t, a.Authorize("root", "*", "consume"))
+	require.Error(t, a.Authorize("nobody", "*", "produce"))
+	require.Error(t, a.Authorize("nobody", "*", "consume"))
+}
+
+func TestRBAC(t *testing.T) {
+	a := New("", writePolicy(t,
+		"p, producers, topics/*, produce, allow",
+		"p, consumers, topics/orders-*, consume, allow",
+		"p, admins, *, *, allow",
+		"p, producers, topics/audit, produce, deny",
+		"p, mallory, *, consume, deny",
+		"g, alice, producers",
+		"g, bob, producers",
+		"g, operators, consumers",
+		"g, carol, operators",
+		"g, dave, admins",
+		"g, mallory, consumers",
+	))
+
+	for _, tc := range []struct {
+		subject string
+		groups  []string
+		object  string
+		action  string
+		allowed bool
+	}{
+		// Direct role membership with a keyMatch object.
+		{"alice", nil, "topics/payments", "produce", true},
+		{"bob", nil, "topics/orders/eu", "produce", true},
+		{"alice", nil, "metrics", "produce", false},
+		{"alice", nil, "topics/payments", "consume", false},
+		// Roles inherit through other roles; glob objects.
+		{"carol", nil, "topics/orders-eu", "consume", true},
+		{"carol", nil, "topics/invoices", "consume", false},
+		// Wildcard actions.
+		{"dave", nil, "anything", "consume", true},
+		// A deny rule wins over an allow for the same role.
+		{"alice", nil, "topics/audit", "produce", false},
+		// Groups from the identity act as roles.
+		{"erin", []string{"operators"}, "topics/orders-us", "consume", true},
+		{"erin", []string{"producers"}, "topics/audit", "produce", false},
+		// A deny for the subject wins over an allow from its roles, and
+		// over an allow from its groups.
+		{"mallory", nil, "topics/orders-eu", "consume", false},
+		{"mallory", []string{"operators"}, "topics/orders-eu", "consume", false},
+	} {
+		err := a.AuthorizeIdentity(Identity{Subject: tc.subject, Groups: tc.groups}, tc.object, tc.action)
+		if tc.allowed {
+			require.NoError(t, err, "%+v", tc)
+		} else {
+			require.Error(t, err, "%+v", tc)
+		}
+	}
+}
+
+func TestMalformedPolicy(t *testing.T) {
+	// A bad glob matches nothing instead of failing every request.
+	a := New("", writePolicy(t,
+		"p, alice, topics/[, consume, allow",
+		"p, alice, topics/*, produce, allow",
+	))
+	require.Error(t, a.Authorize("alice", "topics/orders", "consume"))
+	require.NoError(t, a.Authorize("alice", "topics/orders", "produce"))
+
+	for _, line := range []string{
+		"p, alice, *, produce, allow, extra",
+		"p, alice",
+		", alice, *, produce",
+		"g, alice",
+	} {
+		policy := writePolicy(t, "p, root, *, produce, allow")
+		a := New("", policy)
+		require.NoError(t, os.WriteFile(policy, []byte(line), 0644))
+		require.Error(t, a.Reload(), line)
+		require.NoError(t, a.Authorize("root", "*", "produce"), line)
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	policy := writePolicy(t, "p, root, *, produce, allow")
+	a := New("", policy)
+	errc, err := a.Watch()
+	require.NoError(t, err)
+	defer a.Close()
+	require.Error(t, a.Authorize("alice", "*", "produce"))
+
+	writeFile := func(lines ...string) {
+		tmp := policy + ".new"
+		require.NoError(t, os.WriteFile(tmp, []byte(strings.Join(lines, "\n")), 0644))
+		require.NoError(t, os.Rename(tmp, policy))
+	}
+	writeFile(
+		"p, producers, *, produce, allow",
+		"g, alice, producers",
+	)
+	require.Eventually(t, func() bool {
+		return a.Authorize("alice", "*", "produce") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Error(t, a.Authorize("root", "*", "produce"))
+
+	// A policy that can't be read keeps the current one.
+	require.NoError(t, os.Remove(policy))
+	select {
+	case err := <-errc:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload error")
+	}
+	require.NoError(t, a.Authorize("alice", "*", "produce"))
+}
+
+func TestPolicyAdmin(t *testing.T) {
+	policy := writePolicy(t, "p, root, *, produce")
+	a := New("", policy)
+
+	added, err := a.AddPolicy(Policy{Subject: "consumers", Object: "topics/*", Action: "consume"})
+	require.NoError(t, err)
+	require.True(t, added)
+	added, err = a.AddPolicy(Policy{Subject: "consumers", Object: "topics/*", Action: "consume"})
+	require.NoError(t, err)
+	require.False(t, added)
+	_, err = a.AddPolicy(Policy{Subject: "bob", Object: "topics/secret", Action: "consume", Effect: "deny"})
+	require.NoError(t, err)
+	added, err = a.AddRoleForUser("bob", "consumers")
+	require.NoError(t, err)
+	require.True(t, added)
+	require.NoError(t, a.Authorize("bob", "topics/orders", "consume"))
+	require.Error(t, a.Authorize("bob", "topics/secret", "consume"))
+
+	removed, err := a.RemovePolicy(Policy{Subject: "root", Object: "*", Action: "produce"})
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Error(t, a.Authorize("root", "*", "produce"))
+
+	for _, p := range []Policy{
+		{Subject: "bob", Object: "*", Action: "consume", Effect: "maybe"},
+		{Subject: "bob", Action: "consume"},
+		{Subject: "y, z", Object: "*", Action: "consume"},
+		{Subject: "bob", Object: "*", Action: "consume\np, bob, *, produce"},
+		{Subject: "bob", Object: "topics/[", Action: "consume"},
+	} {
+		_, err := a.AddPolicy(p)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	_, err = a.AddRoleForUser("bob", "consumers, admins")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	b, err := os.ReadFile(policy)
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"p, consumers, topics/*, consume, allow\n"+
+		"p, bob, topics/secret, consume, deny\n"+
+		"g, bob, consumers\n",
+		string(b),
+	)
+	policies, roles := New("", policy).Policies()
+	require.Equal(t, []Policy{
+		{Subject: "consumers", Object: "topics/*", Action: "consume", Effect: "allow"},
+		{Subject: "bob", Object: "topics/secret", Action: "consume", Effect: "deny"},
+	}, policies)
+	require.Equal(t, []RoleAssignment{{User: "bob", Role: "consumers"}}, roles)
+
+	// What was saved loads back and is enforced.
+	require.NoError(t, a.Reload())
+	require.NoError(t, a.Authorize("bob", "topics/orders", "consume"))
+	require.Error(t, a.Authorize("bob", "topics/secret", "consume"))
+	require.Error(t, a.Authorize("root", "*", "produce"))
+
+	_, err = New("", "").AddRoleForUser("bob", "admins")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
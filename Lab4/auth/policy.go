@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/casbin/casbin"
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Policy is one rule of the ACL. Effect is "allow" or "deny"; allow
+// when empty.
+type Policy struct {
+	Subject string
+	Object  string
+	Action  string
+	Effect  string
+}
+
+// RoleAssignment puts User, a subject or another role, in Role.
+type RoleAssignment struct {
+	User string
+	Role string
+}
+
+// Reload reads the model and policy again. On error the current policy
+// stays in use.
+func (a *Authorizer) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	enforcer, deny, err := a.load()
+	if err != nil {
+		return err
+	}
+	a.enforcer, a.deny = enforcer, deny
+	return nil
+}
+
+// Watch reloads the policy whenever its directory changes. Like
+// CertReloader, it watches the directory so swapped symlinks are noticed.
+// The returned channel gets every reload error; it is closed by Close.
+func (a *Authorizer) Watch() (<-chan error, error) {
+	if a.adapter.path == "" {
+		return nil, fmt.Errorf("the embedded policy can't be watched")
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(a.adapter.path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	a.watcher = w
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for {
+			select {
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if err := a.Reload(); err != nil {
+					select {
+					case errc <- err:
+					default:
+					}
+				}
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return errc, nil
+}
+
+func (a *Authorizer) Close() error {
+	if a.watcher == nil {
+		return nil
+	}
+	return a.watcher.Close()
+}
+
+// AddPolicy adds p and saves the policy file. It reports false if the
+// rule already existed.
+func (a *Authorizer) AddPolicy(p Policy) (bool, error) {
+	return a.update(func(e *casbin.Enforcer) (bool, error) {
+		rule, err := a.rule(e, p)
+		if err != nil {
+			return false, err
+		}
+		return e.AddPolicy(rule), nil
+	}, func(e *casbin.Enforcer) {
+		rule, _ := a.rule(e, p)
+		e.RemovePolicy(rule)
+	})
+}
+
+// RemovePolicy removes p and saves the policy file. It reports false if
+// there was no such rule.
+func (a *Authorizer) RemovePolicy(p Policy) (bool, error) {
+	return a.update(func(e *casbin.Enforcer) (bool, error) {
+		rule, err := a.rule(e, p)
+		if err != nil {
+			return false, err
+		}
+		return e.RemovePolicy(rule), nil
+	}, func(e *casbin.Enforcer) {
+		rule, _ := a.rule(e, p)
+		e.AddPolicy(rule)
+	})
+}
+
+// AddRoleForUser puts user in role and saves the policy file. It reports
+// false if user already had the role.
+func (a *Authorizer) AddRoleForUser(user, role string) (bool, error) {
+	return a.update(func(e *casbin.Enforcer) (bool, error) {
+		if user == "" || role == "" {
+			return false, status.Error(codes.InvalidArgument, "user and role are required")
+		}
+		if err := checkFields("user", user, "role", role); err != nil {
+			return false, err
+		}
+		return e.AddRoleForUser(user, role), nil
+	}, func(e *casbin.Enforcer) {
+		e.DeleteRoleForUser(user, role)
+	})
+}
+
+// Policies returns every rule and role assignment in the ACL.
+func (a *Authorizer) Policies() ([]Policy, []RoleAssignment) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var policies []Policy
+	for _, rule := range a.enforcer.GetPolicy() {
+		p := Policy{Subject: rule[0], Object: rule[1], Action: rule[2], Effect: "allow"}
+		if len(rule) > 3 {
+			p.Effect = rule[3]
+		}
+		policies = append(policies, p)
+	}
+	var roles []RoleAssignment
+	for _, rule := range a.enforcer.GetGroupingPolicy() {
+		roles = append(roles, RoleAssignment{User: rule[0], Role: rule[1]})
+	}
+	return policies, roles
+}
+
+// Roles returns every role subject has, directly or through other roles.
+func (a *Authorizer) Roles(subject string) []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.enforcer.GetImplicitRolesForUser(subject)
+}
+
+// update applies change and saves the policy, undoing the change if it
+// can't be saved so memory and file stay in step.
+func (a *Authorizer) update(change func(*casbin.Enforcer) (bool, error), undo func(*casbin.Enforcer)) (bool, error) {
+	if a.adapter.path == "" {
+		return false, status.Error(
+			codes.FailedPrecondition,
+			"the embedded policy is read only; start with a policy file to change it",
+		)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	changed, err := change(a.enforcer)
+	if err != nil || !changed {
+		return changed, err
+	}
+	if err := a.enforcer.SavePolicy(); err != nil {
+		undo(a.enforcer)
+		return false, status.Errorf(codes.Internal, "failed to save policy: %v", err)
+	}
+	return true, nil
+}
+
+// rule turns p into a casbin rule for the loaded model, which may or may
+// not have an effect column.
+func (a *Authorizer) rule(e *casbin.Enforcer, p Policy) ([]string, error) {
+	if p.Subject == "" || p.Object == "" || p.Action == "" {
+		return nil, status.Error(codes.InvalidArgument, "subject, object and action are required")
+	}
+	if p.Effect == "" {
+		p.Effect = "allow"
+	}
+	if p.Effect != "allow" && p.Effect != "deny" {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown effect %q", p.Effect)
+	}
+	if err := checkFields("subject", p.Subject, "object", p.Object, "action", p.Action); err != nil {
+		return nil, err
+	}
+	if _, err := path.Match(p.Object, ""); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "object %q is not a valid pattern", p.Object)
+	}
+	rule := []string{p.Subject, p.Object, p.Action}
+	if len(e.GetModel()["p"]["p"].Tokens) > len(rule) {
+		return append(rule, p.Effect), nil
+	}
+	if p.Effect != "allow" {
+		return nil, status.Error(codes.InvalidArgument, "the ACL model has no deny rules")
+	}
+	return rule, nil
+}
+
+// checkFields rejects values, given as name and value pairs, that would
+// split into more fields or lines in the saved policy file.
+func checkFields(pairs ...string) error {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if strings.ContainsAny(pairs[i+1], ",\r\n") {
+			return status.Errorf(codes.InvalidArgument, "%s %q contains a comma or line break", pairs[i], pairs[i+1])
+		}
+	}
+	return nil
+}
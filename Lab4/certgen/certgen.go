@@ -0,0 +1,379 @@
+package certgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CSR is a certificate request in cfssl's JSON format, as in
+// CA/ca-csr.json, CA/server-csr.json and CA/client-csr.json.
+type CSR struct {
+	CN    string     `json:"CN"`
+	Hosts []string   `json:"hosts"`
+	Key   KeyRequest `json:"key"`
+	Names []Name     `json:"names"`
+}
+
+type KeyRequest struct {
+	Algo string `json:"algo"`
+	Size int    `json:"size"`
+}
+
+type Name struct {
+	C  string `json:"C"`
+	L  string `json:"L"`
+	ST string `json:"ST"`
+	O  string `json:"O"`
+	OU string `json:"OU"`
+}
+
+// Config is cfssl's signing configuration, as in CA/ca-config.json.
+type Config struct {
+	Signing struct {
+		Default  *Profile           `json:"default"`
+		Profiles map[string]Profile `json:"profiles"`
+	} `json:"signing"`
+}
+
+type Profile struct {
+	Expiry string   `json:"expiry"`
+	Usages []string `json:"usages"`
+}
+
+// caExpiry matches cfssl's default for -initca.
+const caExpiry = 5 * 365 * 24 * time.Hour
+
+func ReadCSR(path string) (*CSR, error) {
+	csr := &CSR{}
+	return csr, readJSON(path, csr)
+}
+
+func ReadConfig(path string) (*Config, error) {
+	c := &Config{}
+	return c, readJSON(path, c)
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Profile returns the named signing profile, falling back to the default.
+func (c *Config) Profile(name string) (Profile, error) {
+	if p, ok := c.Signing.Profiles[name]; ok {
+		return p, nil
+	}
+	if c.Signing.Default != nil {
+		return *c.Signing.Default, nil
+	}
+	return Profile{}, fmt.Errorf("unknown signing profile %q", name)
+}
+
+// Cert is a certificate and its private key.
+type Cert struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewCA creates a self-signed CA from req, like cfssl gencert -initca.
+func NewCA(req *CSR) (*Cert, error) {
+	key, err := generateKey(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template(req)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.NotAfter = tmpl.NotBefore.Add(caExpiry)
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	return sign(tmpl, nil, key)
+}
+
+// Load reads a certificate and key written by WriteFiles.
+func Load(certFile, keyFile string) (*Cert, error) {
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = os.ReadFile(keyFile); err != nil {
+		return nil, err
+	}
+	if block, _ = pem.Decode(b); block == nil {
+		return nil, fmt.Errorf("no private key in %s", keyFile)
+	}
+	key, err := parseKey(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cert{Cert: cert, Key: key}, nil
+}
+
+// Issue signs a new certificate for req using profile.
+func (ca *Cert) Issue(req *CSR, profile Profile) (*Cert, error) {
+	key, err := generateKey(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template(req)
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := time.ParseDuration(profile.Expiry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry %q: %w", profile.Expiry, err)
+	}
+	tmpl.NotAfter = tmpl.NotBefore.Add(expiry)
+	for _, u := range profile.Usages {
+		switch u {
+		case "signing", "digital signature":
+			tmpl.KeyUsage |= x509.KeyUsageDigitalSignature
+		case "key encipherment":
+			tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+		case "cert sign":
+			tmpl.KeyUsage |= x509.KeyUsageCertSign
+		case "crl sign":
+			tmpl.KeyUsage |= x509.KeyUsageCRLSign
+		case "server auth":
+			tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+		case "client auth":
+			tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+		default:
+			return nil, fmt.Errorf("unsupported usage %q", u)
+		}
+	}
+	return sign(tmpl, ca, key)
+}
+
+func template(req *CSR) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.CN},
+		NotBefore:    time.Now().Add(-5 * time.Minute).UTC(),
+	}
+	for _, n := range req.Names {
+		appendNonEmpty(&tmpl.Subject.Country, n.C)
+		appendNonEmpty(&tmpl.Subject.Locality, n.L)
+		appendNonEmpty(&tmpl.Subject.Province, n.ST)
+		appendNonEmpty(&tmpl.Subject.Organization, n.O)
+		appendNonEmpty(&tmpl.Subject.OrganizationalUnit, n.OU)
+	}
+	for _, h := range req.Hosts {
+		switch {
+		case h == "":
+		case net.ParseIP(h) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(h))
+		case strings.Contains(h, "://"):
+			u, err := url.Parse(h)
+			if err != nil {
+				return nil, err
+			}
+			tmpl.URIs = append(tmpl.URIs, u)
+		case strings.Contains(h, "@"):
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, h)
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return tmpl, nil
+}
+
+func appendNonEmpty(dst *[]string, v string) {
+	if v != "" {
+		*dst = append(*dst, v)
+	}
+}
+
+func sign(tmpl *x509.Certificate, ca *Cert, key crypto.Signer) (*Cert, error) {
+	parent, parentKey := tmpl, key
+	if ca != nil {
+		parent, parentKey = ca.Cert, ca.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Cert{Cert: cert, Key: key}, nil
+}
+
+func generateKey(req KeyRequest) (crypto.Signer, error) {
+	switch req.Algo {
+	case "", "rsa":
+		size := req.Size
+		if size == 0 {
+			size = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	case "ecdsa":
+		switch req.Size {
+		case 0, 256:
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case 384:
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case 521:
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+	}
+	return nil, fmt.Errorf("unsupported key %s/%d", req.Algo, req.Size)
+}
+
+func parseKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// WriteFiles writes dir/name.pem and dir/name-key.pem, the same names
+// cfssljson -bare uses.
+func (c *Cert) WriteFiles(dir, name string) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw})
+	var keyBlock *pem.Block
+	switch k := c.Key.(type) {
+	case *rsa.PrivateKey:
+		keyBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return err
+		}
+		keyBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	default:
+		return fmt.Errorf("unsupported private key type %T", c.Key)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(keyBlock), 0600)
+}
+
+// Options describes a whole PKI: a CA, one server certificate and a client
+// certificate per name in Clients, written as <name>-client.
+type Options struct {
+	CA      *CSR
+	Server  *CSR
+	Client  *CSR
+	Config  *Config
+	Clients []string
+}
+
+// Generate writes the PKI to dir. An existing ca.pem/ca-key.pem in dir is
+// reused so new certificates stay trusted by existing peers; a new CA is
+// only created when both are missing.
+func Generate(dir string, opts Options) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	var ca *Cert
+	var err error
+	switch {
+	case os.IsNotExist(certErr) && os.IsNotExist(keyErr):
+		if ca, err = NewCA(opts.CA); err == nil {
+			err = ca.WriteFiles(dir, "ca")
+		}
+	case os.IsNotExist(certErr) || os.IsNotExist(keyErr):
+		// A new CA would overwrite the other file and stop every
+		// certificate it issued from validating.
+		err = fmt.Errorf("%s has only one of ca.pem and ca-key.pem; restore the other or remove both", dir)
+	default:
+		ca, err = Load(certFile, keyFile)
+	}
+	if err != nil {
+		return err
+	}
+	issue := func(csr *CSR, profile, name string) error {
+		p, err := opts.Config.Profile(profile)
+		if err != nil {
+			return err
+		}
+		cert, err := ca.Issue(csr, p)
+		if err != nil {
+			return err
+		}
+		return cert.WriteFiles(dir, name)
+	}
+	if opts.Server != nil {
+		if err := issue(opts.Server, "server", "server"); err != nil {
+			return err
+		}
+	}
+	for _, cn := range opts.Clients {
+		csr := *opts.Client
+		csr.CN = cn
+		if err := issue(&csr, "client", cn+"-client"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadOptions reads ca-csr.json, server-csr.json, client-csr.json and
+// ca-config.json from dir.
+func LoadOptions(dir string, clients ...string) (Options, error) {
+	opts := Options{Clients: clients}
+	var err error
+	if opts.CA, err = ReadCSR(filepath.Join(dir, "ca-csr.json")); err != nil {
+		return opts, err
+	}
+	if opts.Server, err = ReadCSR(filepath.Join(dir, "server-csr.json")); err != nil {
+		return opts, err
+	}
+	if opts.Client, err = ReadCSR(filepath.Join(dir, "client-csr.json")); err != nil {
+		return opts, err
+	}
+	opts.Config, err = ReadConfig(filepath.Join(dir, "ca-config.json"))
+	return opts, err
+}
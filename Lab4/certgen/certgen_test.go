@@ -0,0 +1,67 @@
+package certgen
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := LoadOptions("../CA", "root", "alice")
+	require.NoError(t, err)
+	require.NoError(t, Generate(dir, opts))
+
+	ca, err := Load(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	require.NoError(t, err)
+	require.True(t, ca.Cert.IsCA)
+	require.Equal(t, "CA Perron", ca.Cert.Subject.CommonName)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	server, err := Load(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	require.NoError(t, err)
+	_, err = server.Cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		DNSName:   "127.0.0.1",
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	require.NoError(t, err)
+
+	alice, err := Load(filepath.Join(dir, "alice-client.pem"), filepath.Join(dir, "alice-client-key.pem"))
+	require.NoError(t, err)
+	require.Equal(t, "alice", alice.Cert.Subject.CommonName)
+	// Clients share the CSR, so they get no OU to be told apart by.
+	require.Empty(t, alice.Cert.Subject.OrganizationalUnit)
+	_, err = alice.Cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	require.NoError(t, err)
+
+	// Running again keeps the CA so existing certificates stay valid.
+	opts.Clients = []string{"bob"}
+	require.NoError(t, Generate(dir, opts))
+	again, err := Load(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	require.NoError(t, err)
+	require.Equal(t, ca.Cert.Raw, again.Cert.Raw)
+	bob, err := Load(filepath.Join(dir, "bob-client.pem"), filepath.Join(dir, "bob-client-key.pem"))
+	require.NoError(t, err)
+	_, err = bob.Cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	require.NoError(t, err)
+
+	// Without its key the CA is kept, not replaced.
+	before, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(dir, "ca-key.pem")))
+	require.Error(t, Generate(dir, opts))
+	after, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	api "Proyecto/api/v1"
+)
+
+var ErrProducerClosed = errors.New("producer closed")
+
+// Producer sends records over a single ProduceStream keeping up to
+// maxInFlight of them unacknowledged. Send and Recv may be called from
+// different goroutines. Once Recv fails, the stream is done with and
+// Send returns the same error.
+type Producer struct {
+	stream   api.Log_ProduceStreamClient
+	inFlight chan struct{}
+	// failed is closed when Recv fails, waking the Sends waiting for
+	// inFlight.
+	failed chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+func NewProducer(ctx context.Context, client api.LogClient, maxInFlight int) (*Producer, error) {
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	stream, err := client.ProduceStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Producer{
+		stream:   stream,
+		inFlight: make(chan struct{}, maxInFlight),
+		failed:   make(chan struct{}),
+	}, nil
+}
+
+// Send blocks while maxInFlight records are unacknowledged. The server
+// echoes correlationID back in the matching response.
+func (p *Producer) Send(correlationID uint64, record *api.Record) error {
+	select {
+	case p.inFlight <- struct{}{}:
+	case <-p.failed:
+		return p.fail(nil)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.release()
+		return ErrProducerClosed
+	}
+	if p.err != nil {
+		p.release()
+		return p.err
+	}
+	if err := p.stream.Send(&api.ProduceRequest{
+		Record:        record,
+		CorrelationId: correlationID,
+	}); err != nil {
+		p.release()
+		return err
+	}
+	return nil
+}
+
+// Recv returns the next acknowledgement. Per-record failures are reported
+// in the response's Error field rather than as an error from Recv.
+func (p *Producer) Recv() (*api.ProduceResponse, error) {
+	res, err := p.stream.Recv()
+	if err != nil {
+		return nil, p.fail(err)
+	}
+	<-p.inFlight
+	return res, nil
+}
+
+// fail records err as the stream's error, unless one is recorded already,
+// and returns the recorded one. The records in flight are never
+// acknowledged, so their slots are given back.
+func (p *Producer) fail(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil && err != nil {
+		p.err = err
+		close(p.failed)
+		for len(p.inFlight) > 0 {
+			p.release()
+		}
+	}
+	return p.err
+}
+
+// release gives back a slot of inFlight. It doesn't block, as fail may
+// have given them all back already.
+func (p *Producer) release() {
+	select {
+	case <-p.inFlight:
+	default:
+	}
+}
+
+// CloseSend tells the server no more records will be sent; pending
+// acknowledgements can still be received.
+func (p *Producer) CloseSend() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return p.stream.CloseSend()
+}
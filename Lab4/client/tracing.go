@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+
+	api "Proyecto/api/v1"
+	"Proyecto/tracing"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// WithTracing traces every RPC made on the connection and propagates the
+// trace context to the server in gRPC metadata.
+func WithTracing(tp trace.TracerProvider) grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler(
+		otelgrpc.WithTracerProvider(tp),
+		otelgrpc.WithPropagators(tracing.Propagator),
+	))
+}
+
+// Tracer creates producer and consumer spans and carries the producer's
+// trace context inside the record headers, so a consumer reading the
+// record later can link its processing span back to the producer.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: tp.Tracer(tracing.InstrumentationName)}
+}
+
+// Inject writes the trace context in ctx into the record headers.
+func (t *Tracer) Inject(ctx context.Context, record *api.Record) {
+	tracing.Propagator.Inject(ctx, tracing.RecordCarrier{Record: record})
+}
+
+func (t *Tracer) Produce(ctx context.Context, c api.LogClient, record *api.Record) (*api.ProduceResponse, error) {
+	ctx, span := t.tracer.Start(ctx, "produce",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.Int("log.record_size", len(record.Value))),
+	)
+	defer span.End()
+	t.Inject(ctx, record)
+	res, err := c.Produce(ctx, &api.ProduceRequest{Record: record})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int64("log.offset", int64(res.Offset)))
+	return res, nil
+}
+
+// StartProcess starts the span for processing a consumed record, linked to
+// the span that produced it when the record carries a trace context.
+func (t *Tracer) StartProcess(ctx context.Context, record *api.Record) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int64("log.offset", int64(record.Offset)),
+			attribute.Int("log.record_size", len(record.Value)),
+		),
+	}
+	producer := trace.SpanContextFromContext(tracing.Propagator.Extract(
+		context.Background(), tracing.RecordCarrier{Record: record},
+	))
+	if producer.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	return t.tracer.Start(ctx, "process", opts...)
+}
@@ -0,0 +1,40 @@
+// Command certgen issues the CA, server and client certificates the
+// makefile used to create with cfssl, reading the same JSON files.
+//
+//	certgen -csr-dir CA -dir $CONFIG_DIR -clients root,nobody
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"Proyecto/certgen"
+)
+
+func main() {
+	csrDir := flag.String("csr-dir", "CA", "directory holding ca-csr.json, server-csr.json, client-csr.json and ca-config.json")
+	dir := flag.String("dir", os.Getenv("CONFIG_DIR"), "directory to write certificates to (default $CONFIG_DIR)")
+	clients := flag.String("clients", "root,nobody", "comma separated CNs to issue client certificates for")
+	flag.Parse()
+
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "certgen: -dir or CONFIG_DIR is required")
+		os.Exit(2)
+	}
+	var cns []string
+	for _, cn := range strings.Split(*clients, ",") {
+		if cn = strings.TrimSpace(cn); cn != "" {
+			cns = append(cns, cn)
+		}
+	}
+	opts, err := certgen.LoadOptions(*csrDir, cns...)
+	if err == nil {
+		err = certgen.Generate(*dir, opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "certgen:", err)
+		os.Exit(1)
+	}
+}
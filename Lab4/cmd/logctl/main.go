@@ -0,0 +1,180 @@
+// Command logctl works on a log directory. backup can run next to the
+// server; the other commands need the log closed.
+//
+//	logctl rebuild-index -dir DIR [BASE_OFFSET...]
+//	logctl backup -dir DIR [-objects DIR -prefix PREFIX] [-since PREVIOUS] ARCHIVE
+//	logctl restore -dir DIR ARCHIVE...
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	log "Proyecto/log"
+)
+
+const usage = `usage: logctl <command> [flags]
+
+commands:
+  rebuild-index  rewrite segment indexes from their store files
+  backup         write a snapshot archive of the log
+  restore        recreate the log from snapshot archives
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "rebuild-index":
+		err = rebuildIndex(args)
+	case "backup":
+		err = backup(args)
+	case "restore":
+		err = restore(args)
+	default:
+		fmt.Fprintf(os.Stderr, "logctl: unknown command %q\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logctl:", err)
+		os.Exit(1)
+	}
+}
+
+func rebuildIndex(args []string) error {
+	fs := flag.NewFlagSet("rebuild-index", flag.ExitOnError)
+	dir := fs.String("dir", "", "log directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: logctl rebuild-index -dir DIR [BASE_OFFSET...]")
+		fmt.Fprintln(fs.Output(), "Rebuilds the given segments, or all of them.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dir == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var offsets []uint64
+	for _, arg := range fs.Args() {
+		off, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid base offset %q", arg)
+		}
+		offsets = append(offsets, off)
+	}
+	rebuilt, err := log.RebuildIndexes(*dir, offsets...)
+	for _, off := range rebuilt {
+		fmt.Printf("rebuilt %d.index\n", off)
+	}
+	return err
+}
+
+func backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", "", "log directory")
+	objects := fs.String("objects", "", "object store directory the log offloads segments to")
+	prefix := fs.String("prefix", "", "key prefix of the log's objects, required with -objects")
+	since := fs.String("since", "", "archive of a previous backup, to only back up what changed since")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: logctl backup -dir DIR [-objects DIR -prefix PREFIX] [-since PREVIOUS] ARCHIVE")
+		fmt.Fprintln(fs.Output(), "Writes a snapshot of the log to ARCHIVE, or to stdout if it's -.")
+		fmt.Fprintln(fs.Output(), "A log with offsets missing is refused, as its backup couldn't be restored;")
+		fmt.Fprintln(fs.Output(), "one that offloads segments needs its object store.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dir == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var prev *log.Manifest
+	if *since != "" {
+		f, err := os.Open(*since)
+		if err != nil {
+			return err
+		}
+		prev, err = log.ReadManifest(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", *since, err)
+		}
+	}
+	// Read-only, so a running server can keep writing.
+	c := log.Config{ReadOnly: true}
+	if *objects != "" {
+		store, err := log.NewDirObjectStore(*objects)
+		if err != nil {
+			return err
+		}
+		c.Tiering.Store = store
+		c.Tiering.Prefix = *prefix
+	}
+	l, err := log.NewLog(*dir, c)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	switch recovery := l.Recovery(); {
+	case recovery.Offloaded:
+		return errors.New("the log offloads segments; pass its object store with -objects and -prefix")
+	case len(recovery.Gaps) > 0:
+		gap := recovery.Gaps[0]
+		return fmt.Errorf("offsets %d to %d are missing", gap.From, gap.To-1)
+	}
+
+	out := os.Stdout
+	if name := fs.Arg(0); name != "-" {
+		if out, err = os.Create(name); err != nil {
+			return err
+		}
+	}
+	m, err := l.SnapshotSince(out, prev)
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	included := 0
+	for _, s := range m.Segments {
+		if s.Included {
+			included++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "backed up %d of %d segments\n", included, len(m.Segments))
+	return nil
+}
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", "", "log directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: logctl restore -dir DIR ARCHIVE...")
+		fmt.Fprintln(fs.Output(), "Restores a full backup followed by the incremental ones taken after it.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dir == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		m, err := log.RestoreLog(*dir, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Printf("restored %s: %d segments\n", name, len(m.Segments))
+	}
+	return nil
+}
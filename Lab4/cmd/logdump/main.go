@@ -0,0 +1,110 @@
+// Command logdump lists the segments of a log directory, checks them and
+// optionally dumps their records, without changing anything. It exits
+// with status 1 if any segment is inconsistent.
+//
+//	logdump [-records json|hex] DIR
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	log "Proyecto/log"
+)
+
+func main() {
+	records := flag.String("records", "", "dump the records as json or hex")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: logdump [-records json|hex] DIR")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var dump func(log.Frame) error
+	switch *records {
+	case "":
+	case "json":
+		dump = dumpJSON
+	case "hex":
+		dump = dumpHex
+	default:
+		fmt.Fprintf(os.Stderr, "logdump: unknown record format %q\n", *records)
+		os.Exit(2)
+	}
+
+	reports, err := log.Inspect(flag.Arg(0), dump)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logdump:", err)
+		os.Exit(1)
+	}
+	if len(reports) == 0 {
+		fmt.Fprintln(os.Stderr, "logdump: no segments in", flag.Arg(0))
+		os.Exit(1)
+	}
+	if dump != nil {
+		fmt.Println()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "BASE\tNEXT\tSTORE BYTES\tINDEX BYTES\tINDEX VERSION\t")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t\n",
+			r.BaseOffset, r.NextOffset, r.StoreBytes, r.IndexBytes, r.IndexVersion)
+	}
+	w.Flush()
+
+	inconsistent := false
+	for _, r := range reports {
+		for _, p := range r.Problems {
+			fmt.Fprintf(os.Stderr, "segment %d: %v\n", r.BaseOffset, p)
+			inconsistent = true
+		}
+	}
+	if inconsistent {
+		os.Exit(1)
+	}
+}
+
+// dumpJSON prints a line per record. Records that don't decode are
+// printed in hex.
+func dumpJSON(f log.Frame) error {
+	line := struct {
+		Segment  uint64          `json:"segment"`
+		Position uint64          `json:"position"`
+		Record   json.RawMessage `json:"record,omitempty"`
+		Raw      string          `json:"raw,omitempty"`
+	}{Segment: f.BaseOffset, Position: f.Position}
+	if f.Record != nil {
+		b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(f.Record)
+		if err != nil {
+			return err
+		}
+		line.Record = b
+	} else {
+		line.Raw = hex.EncodeToString(f.Data)
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func dumpHex(f log.Frame) error {
+	offset := "undecodable"
+	if f.Record != nil {
+		offset = fmt.Sprint("offset ", f.Record.Offset)
+	}
+	fmt.Printf("segment %d position %d, %s, %d bytes\n", f.BaseOffset, f.Position, offset, len(f.Data))
+	fmt.Print(hex.Dump(f.Data))
+	return nil
+}
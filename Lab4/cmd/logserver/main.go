@@ -0,0 +1,126 @@
+// Command logserver serves a log over HTTP, along with /metrics and the
+// /healthz and /readyz probes, and over gRPC with mutual TLS when
+// -grpc-addr is set, reading the certificates and ACL from $CONFIG_DIR.
+//
+// On SIGINT or SIGTERM it turns NOT_SERVING first and keeps serving for
+// -shutdown-delay, so the readiness probe takes it out of the service
+// before in-flight requests are drained.
+//
+//	logserver -dir DIR [-http-addr :8080] [-grpc-addr :8400]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	tlsconfig "Proyecto/CA"
+	"Proyecto/auth"
+	log "Proyecto/log"
+	"Proyecto/server"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func main() {
+	dir := flag.String("dir", "", "log directory, created if missing")
+	httpAddr := flag.String("http-addr", ":8080", "address to serve HTTP on")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve gRPC on; no gRPC when empty")
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "how long to keep serving once NOT_SERVING before draining")
+	flag.Parse()
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "logserver: -dir is required")
+		os.Exit(2)
+	}
+	if err := run(*dir, *httpAddr, *grpcAddr, *shutdownDelay); err != nil {
+		fmt.Fprintln(os.Stderr, "logserver:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, httpAddr, grpcAddr string, shutdownDelay time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	clog, err := log.NewLog(dir, log.Config{})
+	if err != nil {
+		return err
+	}
+	defer clog.Close()
+
+	health := server.NewHealth()
+	metrics := server.NewMetrics()
+	httpSrv := server.NewHTTPServer(httpAddr, clog, metrics, health)
+	errc := make(chan error, 2)
+	go func() {
+		if err := httpSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errc <- err
+		}
+	}()
+
+	var gsrv *grpc.Server
+	if grpcAddr != "" {
+		tlsConfig, err := tlsconfig.SetupTLSConfig(tlsconfig.TLSConfig{
+			CertFile: tlsconfig.ServerCertFile,
+			KeyFile:  tlsconfig.ServerKeyFile,
+			CAFile:   tlsconfig.CAFile,
+			Server:   true,
+		})
+		if err != nil {
+			return err
+		}
+		authorizer, err := auth.NewAuthorizer(tlsconfig.ACLModelFile, tlsconfig.ACLPolicyFile)
+		if err != nil {
+			return err
+		}
+		gsrv, err = server.NewGRPCServer(&server.Config{
+			CommitLog:  clog,
+			Authorizer: authorizer,
+			Metrics:    metrics,
+			Health:     health,
+		}, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := gsrv.Serve(ln); err != nil {
+				errc <- err
+			}
+		}()
+	} else {
+		// NewGRPCServer registers these otherwise.
+		health.AddCheck("log", clog.Ready)
+		if err := metrics.RegisterLog(clog); err != nil {
+			return err
+		}
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case <-sigc:
+	}
+
+	health.Shutdown()
+	time.Sleep(shutdownDelay)
+	if gsrv != nil {
+		gsrv.GracefulStop()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return httpSrv.Shutdown(ctx)
+}
@@ -1,6 +1,15 @@
 package Log
 
 type Config struct {
+	// ReadOnly opens the log for inspection without taking the directory
+	// lock, so it can coexist with a writer. It sees the records that
+	// were on disk when it was opened, and Append and Truncate fail with
+	// ErrReadOnly.
+	ReadOnly bool
+	// Backend selects where segments are kept; BackendMmap by default.
+	Backend Backend
+	// Tiering offloads closed segments to an object store.
+	Tiering Tiering
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
@@ -1,17 +1,21 @@
 package Log
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
-	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "Proyecto/api/v1"
 )
 
+var ErrNilRecord = errors.New("record is nil")
+
 type Log struct {
 	mu sync.RWMutex
 
@@ -19,7 +23,25 @@ type Log struct {
 	Config Config
 
 	activeSegment *segment
-	segments      []*segment
+	// segments are sorted by base offset and cover disjoint ranges, with
+	// gaps only where setup found segments missing.
+	segments []*segment
+	closed   bool
+	// lastRead caches the segment of the last read, so sequential
+	// consumers skip the search.
+	lastRead atomic.Pointer[segment]
+	storage  Storage
+	// lock is the storage lock held unless Config.ReadOnly.
+	lock     io.Closer
+	recovery Recovery
+	// tier is set when Config.Tiering.Store is, and remote holds the
+	// segments offloaded to it, sorted by base offset.
+	tier   *tier
+	remote []remoteSegment
+	// degraded is set when a segment had to be dropped from the log
+	// while open. Appends and Ready fail with it until the log is
+	// reopened.
+	degraded error
 }
 
 // END: begin
@@ -32,9 +54,14 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	st, err := newStorage(dir, c)
+	if err != nil {
+		return nil, err
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:     dir,
+		Config:  c,
+		storage: st,
 	}
 
 	return l, l.setup()
@@ -43,50 +70,82 @@ func NewLog(dir string, c Config) (*Log, error) {
 // END: newlog
 
 // START: setup
-func (l *Log) setup() error {
-	files, err := os.ReadDir(l.Dir)
-	if err != nil {
-		return err
+func (l *Log) setup() (err error) {
+	if !l.Config.ReadOnly {
+		if l.lock, err = l.storage.Lock(); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				l.lock.Close()
+				l.lock = nil
+			}
+		}()
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
-	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	if l.Config.Tiering.Store != nil {
+		if l.tier, err = newTier(l); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
+	}
+	if err = l.discover(); err != nil {
+		return err
 	}
 	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+		if l.Config.ReadOnly {
+			return fmt.Errorf("no segments in %s", l.Dir)
+		}
+		off := l.Config.Segment.InitialOffset
+		if len(l.remote) > 0 {
+			// Only the offloaded history is left.
+			off = max(off, l.remote[len(l.remote)-1].nextOffset)
+		}
+		if err = l.newSegment(off); err != nil {
 			return err
 		}
 	}
+	now := time.Now()
+	for _, s := range l.segments {
+		if s.closedAt.IsZero() {
+			s.closedAt = now
+		}
+	}
+	l.closed = false
+	l.degraded = nil
+	l.lastRead.Store(nil)
+	if l.tier != nil && !l.Config.ReadOnly {
+		l.tier.start(l)
+	}
 	return nil
 }
 
+// Recovery reports what opening the log found wrong with its directory.
+func (l *Log) Recovery() Recovery {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recovery
+}
+
 // END: setup
 
 // START: append
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	if record == nil {
+		return 0, ErrNilRecord
+	}
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.degraded != nil {
+		return 0, l.degraded
+	}
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
 	if l.activeSegment.IsMaxed() {
+		l.activeSegment.closedAt = time.Now()
 		err = l.newSegment(off + 1)
 	}
 	return off, err
@@ -97,27 +156,43 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 // START: read
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
-	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
-		}
-	}
+	s := l.segmentFor(off)
 	// START: before
 	if s == nil || s.nextOffset <= off {
+		r, ok := l.remoteFor(off)
+		l.mu.RUnlock()
+		if ok {
+			// Fetching an offloaded segment doesn't hold up appends.
+			return l.tier.read(r, off)
+		}
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 	// END: before
+	defer l.mu.RUnlock()
 	return s.Read(off)
 }
 
+// segmentFor returns the segment holding off, or nil if no segment does.
+// Callers must hold l.mu.
+func (l *Log) segmentFor(off uint64) *segment {
+	if s := l.lastRead.Load(); s != nil && s.baseOffset <= off && off < s.nextOffset {
+		return s
+	}
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return off < l.segments[i].nextOffset
+	})
+	if i == len(l.segments) || off < l.segments[i].baseOffset {
+		return nil
+	}
+	l.lastRead.Store(l.segments[i])
+	return l.segments[i]
+}
+
 // END: read
 
 // START: newsegment
 func (l *Log) newSegment(off uint64) error {
-	s, err := newSegment(l.Dir, off, l.Config)
+	s, err := newSegment(l.storage, off, l.Config)
 	if err != nil {
 		return err
 	}
@@ -130,21 +205,59 @@ func (l *Log) newSegment(off uint64) error {
 
 // START: close
 func (l *Log) Close() error {
+	if l.tier != nil {
+		// Before taking l.mu, which background passes need to finish.
+		if err := l.tier.close(); err != nil {
+			return err
+		}
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.closed = true
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
+	if l.lock != nil {
+		err := l.lock.Close()
+		l.lock = nil
+		return err
+	}
 	return nil
 }
 
+// Ready reports whether the log is open and its directory still accepts
+// new files, which it needs to roll over to a new segment.
+func (l *Log) Ready() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return errors.New("log is closed")
+	}
+	if l.degraded != nil {
+		return l.degraded
+	}
+	if l.Config.ReadOnly {
+		return nil
+	}
+	name := fmt.Sprintf(".ready-%d", rand.Int63())
+	f, err := l.storage.Open(name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return l.storage.Remove(name)
+}
+
 func (l *Log) Remove() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	return l.storage.RemoveAll()
 }
 
 func (l *Log) Reset() error {
@@ -160,6 +273,9 @@ func (l *Log) Reset() error {
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if len(l.remote) > 0 && l.remote[0].baseOffset < l.segments[0].baseOffset {
+		return l.remote[0].baseOffset, nil
+	}
 	return l.segments[0].baseOffset, nil
 }
 
@@ -173,16 +289,37 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+func (l *Log) SegmentCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.segments)
+}
+
+// Size returns the bytes used on disk by the store and index files.
+func (l *Log) Size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.size + s.index.size
+	}
+	return size
+}
+
 // END: offsets
 
 // START: truncate
 func (l *Log) Truncate(lowest uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	l.mu.Lock()
-	defer l.mu.Unlock()
 	var segments []*segment
-	for _, s := range l.segments {
+	for i, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
+				l.segments = append(segments, l.segments[i:]...)
+				l.mu.Unlock()
 				return err
 			}
 			continue
@@ -190,6 +327,43 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	l.lastRead.Store(nil)
+	var remote, truncated []remoteSegment
+	for _, r := range l.remote {
+		if r.nextOffset <= lowest+1 {
+			truncated = append(truncated, r)
+			continue
+		}
+		remote = append(remote, r)
+	}
+	l.remote = remote
+	l.mu.Unlock()
+
+	// The object store is slow, so it's not called holding up appends
+	// and reads.
+	for i, r := range truncated {
+		if err := l.tier.delete(r); err != nil {
+			// Put back what's still in the store, or it would
+			// come back anyway when the log is reopened.
+			l.mu.Lock()
+			l.remote = append(truncated[i:], l.remote...)
+			l.mu.Unlock()
+			return err
+		}
+	}
+	if len(truncated) == 0 {
+		return nil
+	}
+	// With nothing left offloaded, the log is whole without its store.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.remote) > 0 || !l.tier.offloaded {
+		return nil
+	}
+	if err := l.storage.Remove(offloadedFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l.tier.offloaded = false
 	return nil
 }
 
@@ -0,0 +1,394 @@
+package Log
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	api "Proyecto/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSegmentLookup(t *testing.T) {
+	c := Config{}
+	// One record per segment.
+	c.Segment.MaxIndexBytes = entWidth
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := 0; i < 50; i++ {
+		off, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.Equal(t, 51, l.SegmentCount())
+
+	for _, off := range append(rand.Perm(50), 0, 1, 2, 3) {
+		record, err := l.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(off), string(record.Value))
+	}
+	_, err = l.Read(50)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	// The cached segment must not outlive truncation.
+	_, err = l.Read(10)
+	require.NoError(t, err)
+	require.NoError(t, l.Truncate(20))
+	_, err = l.Read(10)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = l.Read(21)
+	require.NoError(t, err)
+}
+
+// syntheticLog has segments of ten offsets each with no files behind
+// them, for benchmarking the lookup alone.
+func syntheticLog(n int) *Log {
+	l := &Log{}
+	for i := 0; i < n; i++ {
+		l.segments = append(l.segments, &segment{
+			baseOffset: uint64(i * 10),
+			nextOffset: uint64(i*10 + 10),
+		})
+	}
+	return l
+}
+
+// linearLookup is how Read used to find a segment.
+func linearLookup(l *Log, off uint64) *segment {
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s
+		}
+	}
+	return nil
+}
+
+func BenchmarkSegmentLookup(b *testing.B) {
+	const segments = 10000
+	l := syntheticLog(segments)
+	random := make([]uint64, 4096)
+	for i := range random {
+		random[i] = uint64(rand.Intn(segments * 10))
+	}
+	b.Run("linear/random", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearLookup(l, random[i%len(random)])
+		}
+	})
+	b.Run("binary/random", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			l.lastRead.Store(nil)
+			l.segmentFor(random[i%len(random)])
+		}
+	})
+	b.Run("linear/sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearLookup(l, uint64(i%(segments*10)))
+		}
+	})
+	b.Run("cached/sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			l.segmentFor(uint64(i % (segments * 10)))
+		}
+	})
+}
+
+func TestLogLock(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrLogLocked{Dir: dir, PID: os.Getpid()}, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.activeSegment.store.Flush())
+
+	// A read-only log coexists with the writer and sees what was flushed.
+	ro, err := NewLog(dir, Config{ReadOnly: true})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		record, err := ro.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), string(record.Value))
+	}
+	_, err = ro.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = ro.Append(&api.Record{Value: []byte("nope")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, ro.Truncate(1))
+	require.NoError(t, ro.Close())
+
+	require.NoError(t, l.Close())
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, l.Close())
+
+	_, err = NewLog(t.TempDir(), Config{ReadOnly: true})
+	require.Error(t, err)
+}
+
+func TestSetupDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	// Three records per segment.
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 12; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	require.Equal(t, Recovery{}, l.Recovery())
+
+	// A lost index, a lost segment, an index without its store, a torn
+	// record, and some junk.
+	require.NoError(t, os.Remove(path.Join(dir, "3.index")))
+	require.NoError(t, os.Remove(path.Join(dir, "6.store")))
+	require.NoError(t, os.Remove(path.Join(dir, "6.index")))
+	f, err := os.OpenFile(path.Join(dir, "3.store"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 20, 'x'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.WriteFile(path.Join(dir, "99.index"), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "03.store"), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "notes.txt"), nil, 0644))
+
+	ro, err := NewLog(dir, Config{ReadOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, []Gap{{From: 3, To: 9}}, ro.Recovery().Gaps)
+	require.NoError(t, ro.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	recovery := l.Recovery()
+	require.Equal(t, []uint64{3}, recovery.Rebuilt)
+	require.ElementsMatch(t, []string{"03.store", "notes.txt", "99.index"}, recovery.Quarantined)
+	require.Equal(t, []Gap{{From: 6, To: 9}}, recovery.Gaps)
+	for _, name := range recovery.Quarantined {
+		_, err := os.Stat(path.Join(dir, lostFound, name))
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 12; i++ {
+		record, err := l.Read(uint64(i))
+		if i >= 6 && i < 9 {
+			require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), string(record.Value))
+	}
+	off, err := l.Append(&api.Record{Value: []byte("12")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), off)
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = 4 * entWidth
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	var want []*api.Record
+	for i := 0; i < 10; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprint("record ", i))}
+		_, err := l.Append(record)
+		require.NoError(t, err)
+		want = append(want, record)
+	}
+	requireRecords := func(l *Log) {
+		t.Helper()
+		for _, record := range want {
+			got, err := l.Read(record.Offset)
+			require.NoError(t, err)
+			require.True(t, proto.Equal(record, got))
+		}
+	}
+
+	// Online, with a corrupt index on the closed segment and the
+	// active one.
+	for _, base := range []uint64{4, 8} {
+		s := l.segments[base/4]
+		require.NoError(t, s.store.Flush())
+		for i := range s.index.mmap[:s.index.size] {
+			s.index.mmap[i] = 0xff
+		}
+		require.NoError(t, l.RebuildIndex(base))
+	}
+	requireRecords(l)
+	require.Error(t, l.RebuildIndex(5))
+	_, err = l.Append(&api.Record{Value: []byte("record 10")})
+	require.NoError(t, err)
+	want = append(want, &api.Record{Value: []byte("record 10"), Offset: 10})
+	require.NoError(t, l.Close())
+
+	// Offline, with the indexes gone.
+	for _, base := range []uint64{0, 4, 8} {
+		require.NoError(t, os.Remove(path.Join(dir, fmt.Sprintf("%d.index", base))))
+	}
+	rebuilt, err := RebuildIndexes(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 4, 8}, rebuilt)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, Recovery{}, l.Recovery())
+	requireRecords(l)
+
+	// The offline rebuild won't touch a log that is open.
+	_, err = RebuildIndexes(dir)
+	require.IsType(t, ErrLogLocked{}, err)
+}
+
+func TestRebuildIndexCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint("record ", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// The second record's length runs past the end, but the third
+	// record is still there after it.
+	storeFile := path.Join(dir, "0.store")
+	b, err := os.ReadFile(storeFile)
+	require.NoError(t, err)
+	second := lenWidth + enc.Uint64(b)
+	enc.PutUint64(b[second:], 1<<20)
+	require.NoError(t, os.WriteFile(storeFile, b, 0644))
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+	_, err = RebuildIndexes(dir)
+	require.ErrorContains(t, err, fmt.Sprintf("record at position %d is 1048576 bytes long", second))
+	fi, err := os.Stat(storeFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(b)), fi.Size())
+	_, err = NewLog(dir, Config{})
+	require.Error(t, err)
+
+	// Cut short at the end, it's a torn write and is truncated away.
+	require.NoError(t, os.WriteFile(storeFile, b[:second+lenWidth+3], 0644))
+	_, err = RebuildIndexes(dir)
+	require.NoError(t, err)
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, l.Close())
+}
+
+func TestRebuildIndexFailure(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = 4 * entWidth
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint("record ", i))})
+		require.NoError(t, err)
+	}
+	writeAt := func(name string, b []byte, off int64) {
+		f, err := os.OpenFile(path.Join(dir, name), os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteAt(b, off)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	// Garbles the second record of the segment at base, which the
+	// rebuild then fails on.
+	garble := func(base uint64) {
+		s := l.segments[base/4]
+		require.NoError(t, s.store.Flush())
+		_, pos, err := s.index.Read(1)
+		require.NoError(t, err)
+		writeAt(fmt.Sprintf("%d.store", base), []byte{0xff, 0xff}, int64(pos+lenWidth))
+	}
+
+	// The segment is reopened as it was.
+	garble(0)
+	require.Error(t, l.RebuildIndex(0))
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "record 0", string(record.Value))
+	require.NoError(t, l.Ready())
+
+	// Unless it can't be, and the log says so.
+	garble(8)
+	writeAt("8.index", []byte{0, 0, 0, 99}, versionAt)
+	require.Error(t, l.RebuildIndex(8))
+	_, err = l.Read(8)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = l.Read(4)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("record 10")})
+	require.ErrorContains(t, err, "segment 8 is out of the log")
+	require.Error(t, l.Ready())
+}
+
+func TestBackends(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			c := Config{Backend: backend}
+			c.Segment.MaxIndexBytes = 4 * entWidth
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+				require.NoError(t, err)
+			}
+			require.Equal(t, 3, l.SegmentCount())
+			require.NoError(t, l.Ready())
+			readAll := func(l *Log, from int) {
+				t.Helper()
+				for i := from; i < 10; i++ {
+					record, err := l.Read(uint64(i))
+					require.NoError(t, err)
+					require.Equal(t, fmt.Sprint(i), string(record.Value))
+				}
+			}
+			readAll(l, 0)
+			require.NoError(t, l.Truncate(3))
+			readAll(l, 4)
+
+			if backend == BackendMemory {
+				require.NoError(t, l.Close())
+				entries, err := os.ReadDir(dir)
+				require.NoError(t, err)
+				require.Empty(t, entries)
+				return
+			}
+			// Each backend reads what the others write.
+			require.NoError(t, l.Close())
+			for _, other := range []Backend{BackendMmap, BackendPread} {
+				c.Backend = other
+				l, err = NewLog(dir, c)
+				require.NoError(t, err)
+				readAll(l, 4)
+				_, err = l.Append(&api.Record{Value: []byte("more")})
+				require.NoError(t, err)
+				require.NoError(t, l.Close())
+			}
+		})
+	}
+}
@@ -3,7 +3,7 @@ package Log
 import (
 	"fmt"
 	"os"
-	"path"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 
@@ -11,44 +11,46 @@ import (
 )
 
 type segment struct {
+	storage                Storage
 	store                  *store
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	// closedAt is when the log rolled over to the next segment, and
+	// uploaded whether the segment is in the tiering object store.
+	closedAt time.Time
+	uploaded bool
 }
 
-func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+func newSegment(st Storage, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
+		storage:    st,
 		baseOffset: baseOffset,
 		config:     c,
 	}
-	var err error
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
-	)
+	storeFlag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if c.ReadOnly {
+		storeFlag = os.O_RDONLY
+	}
+	storeFile, err := st.Open(segmentFile(baseOffset, ".store"), storeFlag)
 	if err != nil {
 		return nil, err
 	}
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
-		0644,
-	)
-	if err != nil {
+	if s.index, err = newIndex(st, segmentFile(baseOffset, ".index"), c); err != nil {
 		return nil, err
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
+	// Entries whose records didn't reach the store before an unclean
+	// shutdown, or haven't yet for a read-only log, are dropped.
+	if err := s.index.trim(s.store.size); err != nil {
 		return nil, err
 	}
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+		s.nextOffset = baseOffset + off + 1
 	}
 
 	return s, nil
@@ -68,7 +70,7 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 
 	if err = s.index.Write(
 		// Index offsets are relative to the base offset on the store file
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		s.nextOffset-s.baseOffset,
 		pos,
 	); err != nil {
 		return 0, err
@@ -99,11 +101,11 @@ func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := s.storage.Remove(segmentFile(s.baseOffset, ".index")); err != nil {
 		return err
 	}
 
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := s.storage.Remove(segmentFile(s.baseOffset, ".store")); err != nil {
 		return err
 	}
 	return nil
@@ -120,6 +122,12 @@ func (s *segment) Close() error {
 	return nil
 }
 
+// segmentFile names the segment file with extension ext, ".store" or
+// ".index".
+func segmentFile(baseOffset uint64, ext string) string {
+	return fmt.Sprintf("%d%s", baseOffset, ext)
+}
+
 func nearestMultiple(j, k uint64) uint64 {
 	if j >= 0 {
 		return (j / k) * k
@@ -0,0 +1,187 @@
+package Log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lostFound is the subdirectory setup moves files into when it can't make
+// a segment out of them.
+const lostFound = "lost+found"
+
+// Gap is a range of offsets, [From, To), that no segment covers.
+type Gap struct {
+	From, To uint64
+}
+
+// Recovery describes what setup found wrong with the log directory and
+// what it did about it.
+type Recovery struct {
+	// Rebuilt holds the base offsets of segments whose index was missing
+	// and was rebuilt from the store file.
+	Rebuilt []uint64
+	// Quarantined holds the names of files that aren't part of a segment.
+	// They are moved into lost+found, or left in place by a read-only log.
+	Quarantined []string
+	// Gaps between consecutive segments.
+	Gaps []Gap
+	// Offloaded is set when the log was opened without an object store
+	// but has removed segments locally after uploading them, so they're
+	// missing without showing as gaps.
+	Offloaded bool
+}
+
+// segmentFiles records which of a segment's files are in the directory.
+type segmentFiles struct {
+	store, index bool
+}
+
+// parseSegmentFile splits a file name like "16.store" into its base
+// offset and extension. Only the names newSegment itself would create are
+// accepted, so "016.store" or "16.store.bak" are not segment files.
+func parseSegmentFile(name string) (uint64, string, bool) {
+	ext := path.Ext(name)
+	if ext != ".store" && ext != ".index" {
+		return 0, "", false
+	}
+	offStr := strings.TrimSuffix(name, ext)
+	off, err := strconv.ParseUint(offStr, 10, 64)
+	if err != nil || strconv.FormatUint(off, 10) != offStr {
+		return 0, "", false
+	}
+	return off, ext, true
+}
+
+// groupSegmentFiles groups the segment files among names by base offset.
+// It returns the base offsets in order and the names that aren't segment
+// files, leaving out the lock and dot files, which are the temporaries of
+// Ready and writeFileAtomic.
+func groupSegmentFiles(names []string) (map[uint64]*segmentFiles, []uint64, []string) {
+	found := make(map[uint64]*segmentFiles)
+	var others []string
+	for _, name := range names {
+		if name == lockFile || name == offloadedFile || strings.HasPrefix(name, ".") {
+			continue
+		}
+		off, ext, ok := parseSegmentFile(name)
+		if !ok {
+			others = append(others, name)
+			continue
+		}
+		if found[off] == nil {
+			found[off] = &segmentFiles{}
+		}
+		if ext == ".store" {
+			found[off].store = true
+		} else {
+			found[off].index = true
+		}
+	}
+	baseOffsets := make([]uint64, 0, len(found))
+	for off := range found {
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return found, baseOffsets, others
+}
+
+// discover finds the segments in the log directory, opens them and
+// records what it had to repair in l.recovery. Stores without an index get
+// one rebuilt; anything else that isn't a complete segment is quarantined.
+// A read-only log changes nothing on disk and skips the segments it would
+// have had to repair.
+func (l *Log) discover() error {
+	names, err := l.storage.List()
+	if err != nil {
+		return err
+	}
+	l.recovery = Recovery{}
+	found, baseOffsets, others := groupSegmentFiles(names)
+	for _, name := range others {
+		if err := l.quarantine(name); err != nil {
+			return err
+		}
+	}
+	for _, off := range baseOffsets {
+		switch files := found[off]; {
+		case !files.store:
+			if err := l.quarantine(fmt.Sprintf("%d.index", off)); err != nil {
+				return err
+			}
+			continue
+		case !files.index:
+			if l.Config.ReadOnly {
+				continue
+			}
+			if err := rebuildIndex(l.storage, off); err != nil {
+				return err
+			}
+			l.recovery.Rebuilt = append(l.recovery.Rebuilt, off)
+		}
+		if err := l.newSegment(off); err != nil {
+			return err
+		}
+	}
+
+	// Offloaded segments fill what would otherwise be gaps.
+	ranges := make([]remoteSegment, 0, len(l.segments))
+	for _, s := range l.segments {
+		ranges = append(ranges, remoteSegment{s.baseOffset, s.nextOffset})
+	}
+	offloaded := slices.Contains(names, offloadedFile)
+	if l.tier != nil {
+		l.tier.offloaded = offloaded
+		if err := l.loadRemote(); err != nil {
+			return err
+		}
+		ranges = append(ranges, l.remote...)
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].baseOffset < ranges[j].baseOffset
+		})
+	} else {
+		l.recovery.Offloaded = offloaded
+	}
+	for i := 1; i < len(ranges); i++ {
+		prev, s := ranges[i-1], ranges[i]
+		if prev.nextOffset > s.baseOffset {
+			return fmt.Errorf(
+				"segment %d ends at offset %d, past the start of segment %d",
+				prev.baseOffset, prev.nextOffset, s.baseOffset,
+			)
+		}
+		if prev.nextOffset < s.baseOffset {
+			l.recovery.Gaps = append(l.recovery.Gaps, Gap{From: prev.nextOffset, To: s.baseOffset})
+		}
+	}
+	return nil
+}
+
+// quarantine moves name from the log directory into lost+found, keeping
+// any file already quarantined under the same name.
+func (l *Log) quarantine(name string) error {
+	l.recovery.Quarantined = append(l.recovery.Quarantined, name)
+	if l.Config.ReadOnly {
+		return nil
+	}
+	dst := path.Join(lostFound, name)
+	for i := 1; ; i++ {
+		f, err := l.storage.Open(dst, os.O_RDONLY)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		f.Close()
+		dst = path.Join(lostFound, fmt.Sprintf("%s.%d", name, i))
+	}
+	return l.storage.Rename(name, dst)
+}
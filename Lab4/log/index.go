@@ -1,58 +1,253 @@
 package Log
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"os"
-
-	"github.com/tysonmote/gommap"
 )
 
+// An index file starts with a header of headerWidth bytes: indexMagic,
+// the format version and the bytes of entries that follow. Entries hold
+// the record's offset relative to the segment's base offset and its
+// position in the store, both 64-bit.
+//
+// Version 1 had no size in the header, so its size is the file's, and
+// version 0 had no header and 32-bit relative offsets that wrapped past 4
+// billion records. Both are upgraded when opened.
 var (
-	offWidth uint64 = 4
+	offWidth uint64 = 8
 	posWidth uint64 = 8
 	entWidth        = offWidth + posWidth
+
+	indexMagic = []byte("LIDX")
+)
+
+const (
+	indexVersion uint32 = 2
+	headerWidth  uint64 = 16
+	versionAt           = 4
+	sizeAt              = 8
+
+	legacyOffWidth = 4
+	legacyEntWidth = legacyOffWidth + 8
+
+	// indexChunk is how many bytes of entries the file grows by at a
+	// time, up to MaxIndexBytes.
+	indexChunk = 4096 * 16
 )
 
 type index struct {
-	file *os.File
-	mmap gommap.MMap
-	size uint64
+	storage Storage
+	name    string
+	file    File
+	// mapper is set when file can be mapped. Otherwise entries are read
+	// and written with pread and pwrite.
+	mapper mapper
+	// mmap holds the header followed by the entries and room to append
+	// more.
+	mmap []byte
+	// size is the bytes of entries, not counting the header.
+	size     uint64
+	maxBytes uint64
+	readOnly bool
 }
 
-func newIndex(f *os.File, c Config) (*index, error) {
-	idx := &index{
-		file: f,
+func newIndex(st Storage, name string, c Config) (*index, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if c.ReadOnly {
+		flag = os.O_RDONLY
 	}
-	fi, err := os.Stat(f.Name())
+	f, err := st.Open(name, flag)
 	if err != nil {
 		return nil, err
 	}
-	idx.size = uint64(fi.Size())
-	if err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes),
-	); err != nil {
+	idx := &index{
+		storage:  st,
+		name:     name,
+		maxBytes: c.Segment.MaxIndexBytes,
+		readOnly: c.ReadOnly,
+	}
+	idx.setFile(f)
+	size, err := f.Size()
+	if err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),
-		gommap.PROT_READ|gommap.PROT_WRITE,
-		gommap.MAP_SHARED,
-	); err != nil {
+	if size > 0 {
+		header := make([]byte, headerWidth)
+		if _, err := f.ReadAt(header, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if !bytes.Equal(header[:len(indexMagic)], indexMagic) {
+			return idx, idx.upgrade(size)
+		}
+		if size > headerWidth {
+			idx.size = nearestMultiple(size-headerWidth, entWidth)
+		}
+		switch v := enc.Uint32(header[versionAt:]); v {
+		case 1:
+			// Grown to MaxIndexBytes while open; trim drops the
+			// zeros an unclean shutdown left behind.
+		case indexVersion:
+			// The header may be ahead of the file if the system
+			// crashed before the entries reached the disk.
+			idx.size = min(idx.size, enc.Uint64(header[sizeAt:]))
+		default:
+			return nil, fmt.Errorf("%s: unsupported index version %d", f.Name(), v)
+		}
+	}
+	if c.ReadOnly {
+		return idx, idx.mapReadOnly()
+	}
+	if err := idx.reserve(idx.size); err != nil {
 		return nil, err
 	}
-	return idx, nil
+	return idx, idx.writeHeader()
 }
 
-func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_ASYNC); err != nil {
+func (i *index) setFile(f File) {
+	i.file = f
+	i.mapper, _ = f.(mapper)
+}
+
+// reserve makes room for n bytes of entries. A mapped file grows, and is
+// remapped, in chunks of indexChunk up to maxBytes; an unmapped one grows
+// as it's written.
+func (i *index) reserve(n uint64) error {
+	if i.mapper == nil || i.mmap != nil && headerWidth+n <= uint64(len(i.mmap)) {
+		return nil
+	}
+	capacity := uint64(0)
+	if len(i.mmap) > 0 {
+		capacity = uint64(len(i.mmap)) - headerWidth
+	}
+	for capacity < n || capacity == 0 {
+		capacity += indexChunk
+	}
+	if capacity > i.maxBytes {
+		capacity = max(n, i.maxBytes)
+	}
+	if err := i.mapper.Unmap(); err != nil {
+		return err
+	}
+	i.mmap = nil
+	if err := i.file.Truncate(int64(headerWidth + capacity)); err != nil {
 		return err
 	}
+	var err error
+	i.mmap, err = i.mapper.Map(true)
+	return err
+}
 
-	if err := i.file.Sync(); err != nil {
+func (i *index) writeHeader() error {
+	header := indexHeader(i.size)
+	if i.mmap != nil {
+		copy(i.mmap, header)
+		return nil
+	}
+	_, err := i.file.WriteAt(header, 0)
+	return err
+}
+
+func indexHeader(size uint64) []byte {
+	header := make([]byte, headerWidth)
+	copy(header, indexMagic)
+	enc.PutUint32(header[versionAt:], indexVersion)
+	enc.PutUint64(header[sizeAt:], size)
+	return header
+}
+
+func appendEntry(b []byte, off, pos uint64) []byte {
+	b = enc.AppendUint64(b, off)
+	return enc.AppendUint64(b, pos)
+}
+
+// upgrade converts a version 0 index of size bytes. The file is rewritten
+// in the current format and reopened, unless the log is read-only, in
+// which case the converted index only lives in memory.
+func (i *index) upgrade(size uint64) error {
+	legacy := make([]byte, nearestMultiple(size, legacyEntWidth))
+	if _, err := i.file.ReadAt(legacy, 0); err != nil {
+		return err
+	}
+	// An unclean shutdown leaves the file grown to MaxIndexBytes, so
+	// drop the zero entries at the end. Only the first entry can
+	// legitimately be all zeros.
+	zero := make([]byte, legacyEntWidth)
+	for len(legacy) > legacyEntWidth && bytes.Equal(legacy[len(legacy)-legacyEntWidth:], zero) {
+		legacy = legacy[:len(legacy)-legacyEntWidth]
+	}
+	i.size = uint64(len(legacy)/legacyEntWidth) * entWidth
+	b := indexHeader(i.size)
+	for ent := legacy; len(ent) > 0; ent = ent[legacyEntWidth:] {
+		b = appendEntry(b, uint64(enc.Uint32(ent)), enc.Uint64(ent[legacyOffWidth:]))
+	}
+	if i.readOnly {
+		i.mmap = b
+		return nil
+	}
+
+	if err := writeFileAtomic(i.storage, i.name, b); err != nil {
+		return err
+	}
+	f, err := i.storage.Open(i.name, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	i.file.Close()
+	i.setFile(f)
+	return i.reserve(i.size)
+}
+
+// mapReadOnly maps the file as it is, for a read-only log.
+func (i *index) mapReadOnly() error {
+	if i.size == 0 || i.mapper == nil {
+		return nil
+	}
+	var err error
+	i.mmap, err = i.mapper.Map(false)
+	return err
+}
+
+// trim drops trailing entries that can't be real: ones pointing past the
+// end of the store, whose records were still buffered when the writer
+// stopped, and all-zero ones from a version 1 index grown to
+// MaxIndexBytes. Only the first entry can legitimately be all zeros.
+func (i *index) trim(storeSize uint64) error {
+	size := i.size
+	for i.size > 0 {
+		off, pos, err := i.Read(-1)
+		if err != nil {
+			return err
+		}
+		zero := off == 0 && pos == 0 && i.size > entWidth
+		if !zero && pos+lenWidth <= storeSize {
+			break
+		}
+		i.size -= entWidth
+	}
+	if !i.readOnly && i.size != size {
+		return i.writeHeader()
+	}
+	return nil
+}
+
+func (i *index) Close() error {
+	if i.readOnly {
+		return i.file.Close()
+	}
+	if i.mapper != nil {
+		if err := i.mapper.Unmap(); err != nil {
+			return err
+		}
+		i.mmap = nil
+	}
+
+	if err := i.file.Truncate(int64(headerWidth + i.size)); err != nil {
 		return err
 	}
 
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Sync(); err != nil {
 		return err
 	}
 
@@ -60,31 +255,54 @@ func (i *index) Close() error {
 
 }
 
-func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
+func (i *index) Read(in int64) (out uint64, pos uint64, err error) {
 	if i.size == 0 {
 		return 0, 0, io.EOF
 	}
 	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
+		out = (i.size / entWidth) - 1
 	} else {
-		out = uint32(in)
+		out = uint64(in)
 	}
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	pos = headerWidth + out*entWidth
+	if headerWidth+i.size < pos+entWidth {
 		return 0, 0, io.EOF
 	}
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
-	return out, pos, nil
+	ent := i.mmap
+	if ent != nil {
+		ent = ent[pos : pos+entWidth]
+	} else {
+		ent = make([]byte, entWidth)
+		if _, err := i.file.ReadAt(ent, int64(pos)); err != nil {
+			return 0, 0, err
+		}
+	}
+	return enc.Uint64(ent), enc.Uint64(ent[offWidth:]), nil
 }
-func (i *index) Write(off uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entWidth {
+
+// Write appends an entry and then records the new size in the header, so
+// the header never counts an entry that isn't there.
+func (i *index) Write(off uint64, pos uint64) error {
+	if i.size+entWidth > i.maxBytes {
 		return io.EOF
 	}
-
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
-	i.size += uint64(entWidth)
+	if err := i.reserve(i.size + entWidth); err != nil {
+		return err
+	}
+	end := headerWidth + i.size
+	size := i.size + entWidth
+	if i.mmap != nil {
+		appendEntry(i.mmap[end:end], off, pos)
+		enc.PutUint64(i.mmap[sizeAt:], size)
+	} else {
+		if _, err := i.file.WriteAt(appendEntry(nil, off, pos), int64(end)); err != nil {
+			return err
+		}
+		if _, err := i.file.WriteAt(enc.AppendUint64(nil, size), sizeAt); err != nil {
+			return err
+		}
+	}
+	i.size = size
 	return nil
 }
 
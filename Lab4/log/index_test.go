@@ -0,0 +1,176 @@
+package Log
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	api "Proyecto/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+var backends = []Backend{BackendMmap, BackendPread, BackendMemory}
+
+func TestIndexWideOffsets(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.String(), func(t *testing.T) {
+			c := Config{Backend: backend}
+			c.Segment.MaxIndexBytes = 3 * entWidth
+			st, err := newStorage(t.TempDir(), c)
+			require.NoError(t, err)
+			idx, err := newIndex(st, "0.index", c)
+			require.NoError(t, err)
+
+			// Offsets past math.MaxUint32 used to wrap around to 0.
+			offs := []uint64{math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64}
+			for i, off := range offs {
+				require.NoError(t, idx.Write(off, uint64(i)))
+			}
+			require.Equal(t, io.EOF, idx.Write(0, 0))
+			require.NoError(t, idx.Close())
+
+			idx, err = newIndex(st, "0.index", c)
+			require.NoError(t, err)
+			defer idx.Close()
+			for i, off := range offs {
+				got, pos, err := idx.Read(int64(i))
+				require.NoError(t, err)
+				require.Equal(t, off, got)
+				require.Equal(t, uint64(i), pos)
+			}
+			last, _, err := idx.Read(-1)
+			require.NoError(t, err)
+			require.Equal(t, uint64(math.MaxUint64), last)
+		})
+	}
+}
+
+func TestIndexUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	var legacy []byte
+	for i := uint64(0); i < 3; i++ {
+		_, pos, err := l.activeSegment.index.Read(int64(i))
+		require.NoError(t, err)
+		legacy = enc.AppendUint32(legacy, uint32(i))
+		legacy = enc.AppendUint64(legacy, pos)
+	}
+	require.NoError(t, l.Close())
+	// A version 0 index as left by an unclean shutdown, still grown to
+	// MaxIndexBytes.
+	name := path.Join(dir, "0.index")
+	legacy = append(legacy, make([]byte, 1024-len(legacy))...)
+	require.NoError(t, os.WriteFile(name, legacy, 0644))
+
+	readAll := func(c Config) {
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer l.Close()
+		for i := 0; i < 3; i++ {
+			record, err := l.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte{byte(i)}, record.Value)
+		}
+		_, err = l.Read(3)
+		require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	}
+
+	// A read-only log upgrades in memory and leaves the file alone.
+	readAll(Config{ReadOnly: true})
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, legacy, b)
+
+	readAll(Config{})
+	b, err = os.ReadFile(name)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(b, indexMagic))
+	require.Equal(t, headerWidth+3*entWidth, uint64(len(b)))
+}
+
+func TestIndexGrowth(t *testing.T) {
+	for _, backend := range []Backend{BackendMmap, BackendMemory} {
+		t.Run(backend.String(), func(t *testing.T) {
+			testIndexGrowth(t, backend)
+		})
+	}
+}
+
+func testIndexGrowth(t *testing.T, backend Backend) {
+	c := Config{Backend: backend}
+	c.Segment.MaxIndexBytes = 2*indexChunk + entWidth
+	st, err := newStorage(t.TempDir(), c)
+	require.NoError(t, err)
+	idx, err := newIndex(st, "0.index", c)
+	require.NoError(t, err)
+	defer idx.Close()
+	fileSize := func() uint64 {
+		size, err := idx.file.Size()
+		require.NoError(t, err)
+		return size
+	}
+	require.Equal(t, headerWidth+indexChunk, fileSize())
+
+	n := c.Segment.MaxIndexBytes / entWidth
+	for i := uint64(0); i < n; i++ {
+		require.NoError(t, idx.Write(i, i))
+		if i == indexChunk/entWidth {
+			require.Equal(t, headerWidth+2*indexChunk, fileSize())
+		}
+	}
+	require.Equal(t, io.EOF, idx.Write(n, n))
+	require.Equal(t, headerWidth+c.Segment.MaxIndexBytes, fileSize())
+	for _, i := range []int64{0, indexChunk / int64(entWidth), int64(n) - 1} {
+		off, pos, err := idx.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+		require.Equal(t, uint64(i), pos)
+	}
+}
+
+func TestIndexUncleanShutdown(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1 << 20
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err := l.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+		if i == 4 {
+			require.NoError(t, l.activeSegment.store.Flush())
+		}
+	}
+	// The process dies: the last two records never leave the store's
+	// buffer, while their index entries are in the mapped file.
+	require.NoError(t, l.lock.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	for i := 0; i < 5; i++ {
+		record, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, record.Value)
+	}
+	_, err = l.Read(5)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	off, err = l.Append(&api.Record{Value: []byte{5}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	record, err := l.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5}, record.Value)
+}
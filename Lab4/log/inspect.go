@@ -0,0 +1,196 @@
+package Log
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+
+	api "Proyecto/api/v1"
+)
+
+// SegmentReport is what Inspect found in a segment's files.
+type SegmentReport struct {
+	BaseOffset uint64
+	// NextOffset follows the last record in the store.
+	NextOffset uint64
+	StoreBytes uint64
+	IndexBytes uint64
+	// IndexVersion is the format the index file is in; 0 for the
+	// headerless format, and for a missing index.
+	IndexVersion uint32
+	// Problems are the inconsistencies found; none for a sound segment.
+	Problems []error
+}
+
+// Frame is a record as framed in a store file.
+type Frame struct {
+	BaseOffset uint64
+	Position   uint64
+	// Data is the encoded record and Record the decoded one, or nil if
+	// Data doesn't decode.
+	Data   []byte
+	Record *api.Record
+}
+
+// Inspect checks the segments in the log directory dir: that each store
+// is a run of records with consecutive offsets, that the index points to
+// each of them and nothing else, and that each segment starts where the
+// one before it ends. fn, when not nil, is called with every frame in
+// order, and an error from it stops the inspection.
+//
+// Nothing in dir is changed, so Inspect works next to a Log that has it
+// open, though the active segment may be caught mid-append. Offloaded
+// segments aren't looked at, so the ranges they cover show as gaps.
+func Inspect(dir string, fn func(Frame) error) ([]SegmentReport, error) {
+	st := &dirStorage{dir: dir}
+	names, err := st.List()
+	if err != nil {
+		return nil, err
+	}
+	found, baseOffsets, _ := groupSegmentFiles(names)
+	reports := make([]SegmentReport, 0, len(baseOffsets))
+	for _, off := range baseOffsets {
+		r := SegmentReport{BaseOffset: off, NextOffset: off}
+		var positions []uint64
+		if found[off].store {
+			if positions, err = inspectStore(st, &r, fn); err != nil {
+				return reports, err
+			}
+		} else {
+			r.problem("index without a store file")
+		}
+		if found[off].index {
+			if err := inspectIndex(st, &r, positions); err != nil {
+				return reports, err
+			}
+		} else {
+			r.problem("store without an index file")
+		}
+		if n := len(reports); n > 0 {
+			switch prev := reports[n-1]; {
+			case prev.NextOffset > off:
+				r.problem("overlaps segment %d, which ends at offset %d", prev.BaseOffset, prev.NextOffset)
+			case prev.NextOffset < off:
+				r.problem("offsets %d to %d are missing before it", prev.NextOffset, off-1)
+			}
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+func (r *SegmentReport) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Errorf(format, args...))
+}
+
+// inspectStore walks the records in r's store file and returns their
+// positions. A record that doesn't decode still counts, so the ones after
+// it are checked against the right offsets.
+func inspectStore(st Storage, r *SegmentReport, fn func(Frame) error) ([]uint64, error) {
+	f, err := st.Open(segmentFile(r.BaseOffset, ".store"), os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if r.StoreBytes, err = f.Size(); err != nil {
+		return nil, err
+	}
+
+	var positions []uint64
+	var pos uint64
+	br := bufio.NewReader(io.NewSectionReader(f, 0, int64(r.StoreBytes)))
+	lenBuf := make([]byte, lenWidth)
+	for {
+		if _, err := io.ReadFull(br, lenBuf); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			r.problem("store ends with a partial record length at position %d", pos)
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		n := enc.Uint64(lenBuf)
+		if n > r.StoreBytes-pos-lenWidth {
+			r.problem("record at position %d is %d bytes long, past the end of the store", pos, n)
+			break
+		}
+		frame := Frame{BaseOffset: r.BaseOffset, Position: pos, Data: make([]byte, n)}
+		if _, err := io.ReadFull(br, frame.Data); err != nil {
+			return nil, err
+		}
+		want := r.BaseOffset + uint64(len(positions))
+		record := &api.Record{}
+		if err := proto.Unmarshal(frame.Data, record); err != nil {
+			r.problem("record at position %d doesn't decode: %v", pos, err)
+		} else {
+			frame.Record = record
+			if record.Offset != want {
+				r.problem("record at position %d has offset %d, want %d", pos, record.Offset, want)
+			}
+		}
+		if fn != nil {
+			if err := fn(frame); err != nil {
+				return nil, err
+			}
+		}
+		positions = append(positions, pos)
+		pos += lenWidth + n
+	}
+	r.NextOffset = r.BaseOffset + uint64(len(positions))
+	return positions, nil
+}
+
+// inspectIndex checks that the entries of r's index point to the records
+// at positions, one for one.
+func inspectIndex(st Storage, r *SegmentReport, positions []uint64) error {
+	idx, err := newIndex(st, segmentFile(r.BaseOffset, ".index"), Config{ReadOnly: true})
+	if err != nil {
+		r.problem("%v", err)
+		return nil
+	}
+	defer idx.Close()
+	if r.IndexBytes, err = idx.file.Size(); err != nil {
+		return err
+	}
+	header := make([]byte, headerWidth)
+	if n, _ := idx.file.ReadAt(header, 0); n == len(header) && bytes.HasPrefix(header, indexMagic) {
+		r.IndexVersion = enc.Uint32(header[versionAt:])
+	}
+
+	// Older formats leave the file padded with zero entries, which only
+	// count as an entry for the first record.
+	for idx.size > 0 {
+		off, pos, err := idx.Read(-1)
+		if err != nil {
+			return err
+		}
+		if off != 0 || pos != 0 || idx.size == entWidth && len(positions) > 0 {
+			break
+		}
+		idx.size -= entWidth
+	}
+
+	entries := idx.size / entWidth
+	for i := uint64(0); i < entries && i < uint64(len(positions)); i++ {
+		off, pos, err := idx.Read(int64(i))
+		if err != nil {
+			return err
+		}
+		if off != i {
+			r.problem("index entry %d has relative offset %d", i, off)
+		}
+		if pos != positions[i] {
+			r.problem("index entry %d points to position %d, but the record is at %d", i, pos, positions[i])
+		}
+	}
+	if n := uint64(len(positions)); entries > n {
+		r.problem("index has %d entries past the last record in the store", entries-n)
+	} else if entries < n {
+		r.problem("last %d records in the store aren't in the index", n-entries)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package Log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	api "Proyecto/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = 4 * entWidth
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint("record ", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	var frames []Frame
+	reports, err := Inspect(dir, func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+	for i, r := range reports {
+		require.Empty(t, r.Problems)
+		require.Equal(t, uint64(4*i), r.BaseOffset)
+		require.Equal(t, min(uint64(4*i+4), 10), r.NextOffset)
+		require.Equal(t, indexVersion, r.IndexVersion)
+		require.Equal(t, headerWidth+(r.NextOffset-r.BaseOffset)*entWidth, r.IndexBytes)
+	}
+	require.Len(t, frames, 10)
+	for i, f := range frames {
+		require.Equal(t, uint64(i), f.Record.Offset)
+		require.Equal(t, fmt.Sprint("record ", i), string(f.Record.Value))
+	}
+
+	// The index points to the wrong record, offsets 4 to 7 are gone, and
+	// the last store ends in a torn record.
+	b, err := os.ReadFile(path.Join(dir, "0.index"))
+	require.NoError(t, err)
+	enc.PutUint64(b[headerWidth+entWidth+offWidth:], 0)
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.index"), b, 0644))
+	require.NoError(t, os.Remove(path.Join(dir, "4.index")))
+	require.NoError(t, os.Remove(path.Join(dir, "4.store")))
+	f, err := os.OpenFile(path.Join(dir, "8.store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reports, err = Inspect(dir, nil)
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	require.Len(t, reports[0].Problems, 1)
+	require.ErrorContains(t, reports[0].Problems[0], "index entry 1 points to position 0")
+	require.Equal(t, uint64(10), reports[1].NextOffset)
+	require.Len(t, reports[1].Problems, 2)
+	require.ErrorContains(t, reports[1].Problems[0], "partial record length")
+	require.ErrorContains(t, reports[1].Problems[1], "offsets 4 to 7 are missing")
+}
+
+func TestInspectLegacyPadding(t *testing.T) {
+	// An empty segment with a version 0 index grown to MaxIndexBytes, as
+	// left by an unclean shutdown.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.index"), make([]byte, 1024), 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.store"), nil, 0644))
+	reports, err := Inspect(dir, nil)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentReport{{IndexBytes: 1024}}, reports)
+}
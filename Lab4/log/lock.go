@@ -0,0 +1,68 @@
+package Log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFile is held with flock by the Log writing to a directory and holds
+// its PID.
+const lockFile = "LOCK"
+
+var ErrReadOnly = errors.New("log is read-only")
+
+// ErrLogLocked is returned by NewLog when another Log, in this process or
+// another one, already has the directory open for writing.
+type ErrLogLocked struct {
+	Dir string
+	// PID of the holder, or 0 if it couldn't be read.
+	PID int
+}
+
+func (e ErrLogLocked) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("log %s is locked by another process", e.Dir)
+	}
+	return fmt.Sprintf("log %s is locked by process %d", e.Dir, e.PID)
+}
+
+// lockDir takes the exclusive advisory lock on dir. The lock goes away
+// with the process, so a crash never leaves a stale lock behind.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			b, _ := io.ReadAll(f)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+			return nil, ErrLogLocked{Dir: dir, PID: pid}
+		}
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		unlockDir(f)
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		unlockDir(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlockDir(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
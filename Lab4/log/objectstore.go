@@ -0,0 +1,102 @@
+package Log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ObjectStore is an S3-compatible object store that closed segments are
+// offloaded to. Keys are flat names without slashes.
+type ObjectStore interface {
+	Put(key string, r io.Reader) error
+	// Get returns an error wrapping os.ErrNotExist for a missing key.
+	Get(key string) (io.ReadCloser, error)
+	// Delete succeeds for a missing key.
+	Delete(key string) error
+	List() ([]string, error)
+}
+
+// DirObjectStore is an ObjectStore that keeps objects as files in a
+// directory, to run without an object store, and in tests.
+type DirObjectStore struct {
+	Dir string
+}
+
+func NewDirObjectStore(dir string) (*DirObjectStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirObjectStore{Dir: dir}, nil
+}
+
+func (d *DirObjectStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(d.Dir, key), nil
+}
+
+// Put writes the object to a temporary file first, so Get and List never
+// see a partial object.
+func (d *DirObjectStore) Put(key string, r io.Reader) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.Dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (d *DirObjectStore) Get(key string) (io.ReadCloser, error) {
+	name, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+func (d *DirObjectStore) Delete(key string) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *DirObjectStore) List() ([]string, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			keys = append(keys, e.Name())
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,199 @@
+package Log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	api "Proyecto/api/v1"
+)
+
+// RebuildIndex rewrites the index of the open segment at baseOffset from
+// its store file, for when the index is corrupt. Reads of the segment
+// block until it's done.
+func (l *Log) RebuildIndex(baseOffset uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset >= baseOffset
+	})
+	if i == len(l.segments) || l.segments[i].baseOffset != baseOffset {
+		return fmt.Errorf("no segment with base offset %d", baseOffset)
+	}
+	l.lastRead.Store(nil)
+	old := l.segments[i]
+	// Closing flushes the store, so the rebuild sees every record.
+	if err := old.Close(); err != nil {
+		return err
+	}
+	err := rebuildIndex(l.storage, baseOffset)
+	var s *segment
+	if err == nil {
+		s, err = newSegment(l.storage, baseOffset, l.Config)
+	}
+	if err != nil {
+		// The old files are still there, the index only being replaced
+		// once rebuilt, so the segment goes back to how it was.
+		reopened, reopenErr := newSegment(l.storage, baseOffset, l.Config)
+		if reopenErr != nil {
+			l.segments = append(l.segments[:i:i], l.segments[i+1:]...)
+			l.degraded = fmt.Errorf(
+				"segment %d is out of the log after a failed index rebuild: %w",
+				baseOffset, errors.Join(err, reopenErr),
+			)
+			return l.degraded
+		}
+		l.replaceSegment(i, reopened)
+		return fmt.Errorf("rebuilding the index of segment %d: %w", baseOffset, err)
+	}
+	l.replaceSegment(i, s)
+	return nil
+}
+
+// replaceSegment puts s, a reopened copy of the i'th segment, in its
+// place, keeping its tiering state. Callers hold l.mu.
+func (l *Log) replaceSegment(i int, s *segment) {
+	old := l.segments[i]
+	s.closedAt, s.uploaded = old.closedAt, old.uploaded
+	if l.activeSegment == old {
+		l.activeSegment = s
+	}
+	l.segments[i] = s
+}
+
+// RebuildIndexes rewrites the indexes of the segments at baseOffsets, or
+// of every segment when none are given, in the log directory dir while no
+// Log has it open. It returns the base offsets it rebuilt.
+func RebuildIndexes(dir string, baseOffsets ...uint64) ([]uint64, error) {
+	st := &dirStorage{dir: dir}
+	lock, err := st.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if len(baseOffsets) == 0 {
+		names, err := st.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if off, ext, ok := parseSegmentFile(name); ok && ext == ".store" {
+				baseOffsets = append(baseOffsets, off)
+			}
+		}
+		sort.Slice(baseOffsets, func(i, j int) bool {
+			return baseOffsets[i] < baseOffsets[j]
+		})
+	}
+	for i, off := range baseOffsets {
+		if err := rebuildIndex(st, off); err != nil {
+			return baseOffsets[:i], err
+		}
+	}
+	return baseOffsets, nil
+}
+
+// rebuildIndex writes the index of the segment at baseOffset from its
+// store file, checking that each record holds the offset its position
+// implies. A record cut short at the end of the store, as left by a crash
+// mid-write, is truncated away. A record whose length runs past the end
+// but that has records after it has a corrupt length instead, and is an
+// error, since truncating would lose the records after it.
+func rebuildIndex(st Storage, baseOffset uint64) error {
+	f, err := st.Open(segmentFile(baseOffset, ".store"), os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+
+	var entries, p []byte
+	var pos uint64
+	r := bufio.NewReader(io.NewSectionReader(f, 0, int64(size)))
+	lenBuf := make([]byte, lenWidth)
+	record := &api.Record{}
+	for off := uint64(0); ; off++ {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		n := enc.Uint64(lenBuf)
+		if n > size-pos-lenWidth {
+			// Only the last write can be torn, so the record is the
+			// tail unless the next one comes after it.
+			next, found, err := findRecord(f, pos+lenWidth, size, baseOffset+off+1)
+			if err != nil {
+				return err
+			}
+			if found {
+				return fmt.Errorf(
+					"%s: record at position %d is %d bytes long, past the end of the store, but record %d follows at position %d",
+					f.Name(), pos, n, baseOffset+off+1, next,
+				)
+			}
+			break
+		}
+		if uint64(cap(p)) < n {
+			p = make([]byte, n)
+		}
+		p = p[:n]
+		if _, err := io.ReadFull(r, p); err != nil {
+			return err
+		}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return fmt.Errorf("%s: record at position %d: %w", f.Name(), pos, err)
+		}
+		if record.Offset != baseOffset+off {
+			return fmt.Errorf(
+				"%s: record at position %d has offset %d, want %d",
+				f.Name(), pos, record.Offset, baseOffset+off,
+			)
+		}
+		entries = appendEntry(entries, off, pos)
+		pos += lenWidth + n
+	}
+	if pos < size {
+		if err := f.Truncate(int64(pos)); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(
+		st,
+		segmentFile(baseOffset, ".index"),
+		append(indexHeader(uint64(len(entries))), entries...),
+	)
+}
+
+// findRecord looks for the record with the given offset framed anywhere
+// in the store between from and size, returning its position.
+func findRecord(f File, from, size, offset uint64) (uint64, bool, error) {
+	b := make([]byte, size-from)
+	if _, err := f.ReadAt(b, int64(from)); err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	record := &api.Record{}
+	for i := uint64(0); i+lenWidth <= uint64(len(b)); i++ {
+		n := enc.Uint64(b[i:])
+		if n > uint64(len(b))-i-lenWidth {
+			continue
+		}
+		if proto.Unmarshal(b[i+lenWidth:i+lenWidth+n], record) == nil && record.Offset == offset {
+			return from + i, true, nil
+		}
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,285 @@
+package Log
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A snapshot is a tar archive of segment files under snapshotDir,
+// followed by manifestName describing them.
+const (
+	snapshotVersion = 1
+	snapshotDir     = "segments/"
+	manifestName    = "MANIFEST.json"
+)
+
+// Manifest describes a snapshot.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Config    struct {
+		MaxStoreBytes uint64 `json:"max_store_bytes"`
+		MaxIndexBytes uint64 `json:"max_index_bytes"`
+		InitialOffset uint64 `json:"initial_offset"`
+	} `json:"config"`
+	Segments []SegmentManifest `json:"segments"`
+}
+
+type SegmentManifest struct {
+	BaseOffset uint64       `json:"base_offset"`
+	NextOffset uint64       `json:"next_offset"`
+	Store      FileManifest `json:"store"`
+	Index      FileManifest `json:"index"`
+	// Included is false in an incremental snapshot for a segment that is
+	// unchanged since the previous snapshot, and so isn't in the archive.
+	Included bool `json:"included"`
+}
+
+type FileManifest struct {
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func fileManifest(b []byte) FileManifest {
+	sum := sha256.Sum256(b)
+	return FileManifest{Size: uint64(len(b)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// Snapshot writes an archive of the whole log, offloaded segments
+// included, to w.
+func (l *Log) Snapshot(w io.Writer) (*Manifest, error) {
+	return l.SnapshotSince(w, nil)
+}
+
+// SnapshotSince writes an archive of the segments that changed since the
+// snapshot described by prev; restoring it needs prev restored first. A
+// nil prev takes a full snapshot.
+//
+// Each segment is copied under the log's read lock, so appends carry on
+// between segments; the active segment is captured as of when it's
+// reached.
+func (l *Log) SnapshotSince(w io.Writer, prev *Manifest) (*Manifest, error) {
+	m := &Manifest{Version: snapshotVersion, CreatedAt: time.Now().UTC()}
+	m.Config.MaxStoreBytes = l.Config.Segment.MaxStoreBytes
+	m.Config.MaxIndexBytes = l.Config.Segment.MaxIndexBytes
+	m.Config.InitialOffset = l.Config.Segment.InitialOffset
+	unchanged := make(map[SegmentManifest]bool)
+	if prev != nil {
+		for _, s := range prev.Segments {
+			s.Included = false
+			unchanged[s] = true
+		}
+	}
+
+	l.mu.RLock()
+	segments := append([]*segment(nil), l.segments...)
+	remote := append([]remoteSegment(nil), l.remote...)
+	l.mu.RUnlock()
+
+	tw := tar.NewWriter(w)
+	add := func(base, next uint64, store, index []byte) error {
+		sm := SegmentManifest{
+			BaseOffset: base,
+			NextOffset: next,
+			Store:      fileManifest(store),
+			Index:      fileManifest(index),
+		}
+		if !unchanged[sm] {
+			sm.Included = true
+			if err := writeTarFile(tw, snapshotDir+segmentFile(base, ".index"), index); err != nil {
+				return err
+			}
+			if err := writeTarFile(tw, snapshotDir+segmentFile(base, ".store"), store); err != nil {
+				return err
+			}
+		}
+		m.Segments = append(m.Segments, sm)
+		return nil
+	}
+	for _, r := range remote {
+		store, index, err := l.tier.contents(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(r.baseOffset, r.nextOffset, store, index); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range segments {
+		l.mu.RLock()
+		if !l.hasSegment(s) {
+			// Truncated or offloaded since; an offloaded one is in
+			// the next snapshot.
+			l.mu.RUnlock()
+			continue
+		}
+		next := s.nextOffset
+		store, index, err := s.contents()
+		l.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		if err := add(s.baseOffset, next, store, index); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, manifestName, b); err != nil {
+		return nil, err
+	}
+	return m, tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+// ReadManifest reads the manifest of the archive in r, to take an
+// incremental snapshot from it.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("snapshot has no manifest")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == manifestName {
+			return decodeManifest(tr)
+		}
+	}
+}
+
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	if m.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", m.Version)
+	}
+	return m, nil
+}
+
+// RestoreLog recreates the segments of the snapshot in r in dir, which no
+// Log may have open. Segments left out of an incremental snapshot must
+// already be in dir, as restored from the snapshots before it, and
+// segments in dir that aren't in the snapshot are removed. Nothing in dir
+// changes unless the whole archive checks out against its manifest.
+func RestoreLog(dir string, r io.Reader) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	st := &dirStorage{dir: dir}
+	lock, err := st.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	// Files are staged as dot files, which setup ignores, until the
+	// manifest at the end vouches for them.
+	staged := make(map[string]FileManifest)
+	defer func() {
+		for name := range staged {
+			st.Remove(stagedName(name))
+		}
+	}()
+	var m *Manifest
+	tr := tar.NewReader(r)
+	for m == nil {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("snapshot has no manifest")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == manifestName {
+			if m, err = decodeManifest(tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name, ok := strings.CutPrefix(hdr.Name, snapshotDir)
+		if _, _, valid := parseSegmentFile(name); !ok || !valid {
+			return nil, fmt.Errorf("unexpected file %q in snapshot", hdr.Name)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFile(st, stagedName(name), b); err != nil {
+			return nil, err
+		}
+		staged[name] = fileManifest(b)
+	}
+
+	keep := make(map[string]bool)
+	for _, s := range m.Segments {
+		for name, want := range map[string]FileManifest{
+			segmentFile(s.BaseOffset, ".store"): s.Store,
+			segmentFile(s.BaseOffset, ".index"): s.Index,
+		} {
+			keep[name] = true
+			got, ok := staged[name]
+			if !s.Included {
+				b, err := os.ReadFile(path.Join(dir, name))
+				if err != nil {
+					return nil, fmt.Errorf("incremental snapshot needs %s from a previous one: %w", name, err)
+				}
+				got, ok = fileManifest(b), true
+			}
+			if !ok || got != want {
+				return nil, fmt.Errorf("%s doesn't match the snapshot manifest", name)
+			}
+		}
+	}
+
+	for name := range staged {
+		if err := st.Rename(stagedName(name), name); err != nil {
+			return nil, err
+		}
+		delete(staged, name)
+	}
+	names, err := st.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if _, _, ok := parseSegmentFile(name); ok && !keep[name] {
+			if err := st.Remove(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+func stagedName(name string) string {
+	return "." + name + ".restore"
+}
@@ -0,0 +1,138 @@
+package Log
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	api "Proyecto/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	var want []*api.Record
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			record := &api.Record{Value: []byte(fmt.Sprint("record ", len(want)))}
+			_, err := l.Append(record)
+			require.NoError(t, err)
+			want = append(want, record)
+		}
+	}
+	requireRestored := func(dir string) {
+		t.Helper()
+		restored, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer restored.Close()
+		require.Equal(t, Recovery{}, restored.Recovery())
+		for _, record := range want {
+			got, err := restored.Read(record.Offset)
+			require.NoError(t, err)
+			require.True(t, proto.Equal(record, got))
+		}
+		_, err = restored.Read(want[len(want)-1].Offset + 1)
+		require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	}
+
+	appendN(7)
+	var full bytes.Buffer
+	m, err := l.Snapshot(&full)
+	require.NoError(t, err)
+	require.Len(t, m.Segments, 3)
+	require.Equal(t, uint64(6), m.Segments[2].BaseOffset)
+	require.Equal(t, uint64(7), m.Segments[2].NextOffset)
+	read, err := ReadManifest(bytes.NewReader(full.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, m.Segments, read.Segments)
+
+	dir := t.TempDir()
+	_, err = RestoreLog(dir, bytes.NewReader(full.Bytes()))
+	require.NoError(t, err)
+	requireRestored(dir)
+
+	// An incremental snapshot carries the segments that changed: the
+	// one that was active and the new ones.
+	appendN(4)
+	var incr bytes.Buffer
+	m, err = l.SnapshotSince(&incr, read)
+	require.NoError(t, err)
+	var included []uint64
+	for _, s := range m.Segments {
+		if s.Included {
+			included = append(included, s.BaseOffset)
+		}
+	}
+	require.Equal(t, []uint64{6, 9}, included)
+	require.Less(t, incr.Len(), full.Len())
+
+	// It can't be restored on its own.
+	_, err = RestoreLog(t.TempDir(), bytes.NewReader(incr.Bytes()))
+	require.Error(t, err)
+
+	_, err = RestoreLog(dir, bytes.NewReader(incr.Bytes()))
+	require.NoError(t, err)
+	requireRestored(dir)
+
+	// A truncated log restores without the segments it dropped.
+	require.NoError(t, l.Truncate(3))
+	want = want[6:]
+	full.Reset()
+	_, err = l.Snapshot(&full)
+	require.NoError(t, err)
+	_, err = RestoreLog(dir, bytes.NewReader(full.Bytes()))
+	require.NoError(t, err)
+	_, err = os.Stat(path.Join(dir, "0.store"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	requireRestored(dir)
+}
+
+func TestRestoreRejectsCorruptSnapshot(t *testing.T) {
+	l, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = l.Snapshot(&buf)
+	require.NoError(t, err)
+
+	// Flip a byte of the store in the archive.
+	var corrupt bytes.Buffer
+	tr := tar.NewReader(&buf)
+	tw := tar.NewWriter(&corrupt)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		if hdr.Name == snapshotDir+"0.store" {
+			b[len(b)-1] ^= 0xff
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(b)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	dir := t.TempDir()
+	_, err = RestoreLog(dir, &corrupt)
+	require.ErrorContains(t, err, "0.store doesn't match")
+	names, err := (&dirStorage{dir: dir}).List()
+	require.NoError(t, err)
+	// Only the lock file is left behind.
+	require.Equal(t, []string{lockFile}, names)
+}
@@ -0,0 +1,115 @@
+package Log
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Backend selects where a log keeps its segments.
+type Backend int
+
+const (
+	// BackendMmap keeps segments in files in the log directory and maps
+	// indexes into memory.
+	BackendMmap Backend = iota
+	// BackendPread keeps segments in files like BackendMmap but reads
+	// and writes indexes with pread and pwrite, for platforms where
+	// mmap is undesirable.
+	BackendPread
+	// BackendMemory keeps segments in memory, for tests and ephemeral
+	// logs. Nothing is written to the log directory, and the records
+	// are gone once the Log is garbage collected.
+	BackendMemory
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendMmap:
+		return "mmap"
+	case BackendPread:
+		return "pread"
+	case BackendMemory:
+		return "memory"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// Storage holds a log's files. Names are relative to the log and may
+// contain a slash to place a file in a subdirectory.
+type Storage interface {
+	// Open opens name with os.OpenFile flags; only O_RDONLY, O_RDWR,
+	// O_CREATE, O_TRUNC and O_APPEND are meaningful.
+	Open(name string, flag int) (File, error)
+	// List returns the names of the files at the top level.
+	List() ([]string, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	// RemoveAll removes every file, and the log directory if there is one.
+	RemoveAll() error
+	// Lock takes the storage for a single writer until the returned
+	// lock is closed.
+	Lock() (io.Closer, error)
+}
+
+// File is a file of a Storage.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	// Append writes p at the end of the file.
+	Append(p []byte) (int, error)
+	Size() (uint64, error)
+	Sync() error
+	Truncate(size int64) error
+	Name() string
+}
+
+// mapper is implemented by Files that an index can map into memory. Map
+// returns the whole file; writes to a writable mapping change the file.
+type mapper interface {
+	Map(writable bool) ([]byte, error)
+	// Unmap flushes a writable mapping to the file and releases it.
+	Unmap() error
+}
+
+func newStorage(dir string, c Config) (Storage, error) {
+	switch c.Backend {
+	case BackendMmap:
+		return &dirStorage{dir: dir, mmap: true}, nil
+	case BackendPread:
+		return &dirStorage{dir: dir}, nil
+	case BackendMemory:
+		return newMemStorage(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %v", c.Backend)
+}
+
+// writeFileAtomic replaces name with a file holding b, so a crash leaves
+// either the old file or the new one. The temporary file is a dot file,
+// which setup ignores.
+func writeFileAtomic(st Storage, name string, b []byte) error {
+	tmp := "." + name + ".tmp"
+	if err := writeFile(st, tmp, b); err != nil {
+		st.Remove(tmp)
+		return err
+	}
+	return st.Rename(tmp, name)
+}
+
+// writeFile creates or truncates name and writes b to it.
+func writeFile(st Storage, name string, b []byte) error {
+	f, err := st.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(b, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,126 @@
+package Log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/tysonmote/gommap"
+)
+
+// dirStorage keeps a log's files in a directory.
+type dirStorage struct {
+	dir string
+	// mmap lets indexes map their files.
+	mmap bool
+}
+
+func (d *dirStorage) Open(name string, flag int) (File, error) {
+	f, err := os.OpenFile(path.Join(d.dir, name), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if d.mmap {
+		return &mmapFile{osFile: osFile{f}}, nil
+	}
+	return osFile{f}, nil
+}
+
+func (d *dirStorage) List() ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *dirStorage) Rename(oldname, newname string) error {
+	newpath := path.Join(d.dir, newname)
+	if err := os.MkdirAll(path.Dir(newpath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path.Join(d.dir, oldname), newpath)
+}
+
+func (d *dirStorage) Remove(name string) error {
+	return os.Remove(path.Join(d.dir, name))
+}
+
+func (d *dirStorage) RemoveAll() error {
+	return os.RemoveAll(d.dir)
+}
+
+func (d *dirStorage) Lock() (io.Closer, error) {
+	f, err := lockDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	return dirLock{f}, nil
+}
+
+type dirLock struct {
+	f *os.File
+}
+
+func (l dirLock) Close() error {
+	return unlockDir(l.f)
+}
+
+// osFile reads and writes with pread and pwrite. Append relies on the
+// file being opened with O_APPEND.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Append(p []byte) (int, error) {
+	return f.File.Write(p)
+}
+
+func (f osFile) Size() (uint64, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fi.Size()), nil
+}
+
+// mmapFile is an osFile that can be mapped.
+type mmapFile struct {
+	osFile
+	mmap gommap.MMap
+}
+
+func (f *mmapFile) Map(writable bool) ([]byte, error) {
+	if f.mmap != nil {
+		return nil, errors.New("file is already mapped")
+	}
+	prot := gommap.PROT_READ
+	if writable {
+		prot |= gommap.PROT_WRITE
+	}
+	m, err := gommap.Map(f.Fd(), prot, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	f.mmap = m
+	return m, nil
+}
+
+func (f *mmapFile) Unmap() error {
+	if f.mmap == nil {
+		return nil
+	}
+	if err := f.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	err := f.mmap.UnsafeUnmap()
+	f.mmap = nil
+	return err
+}
@@ -0,0 +1,190 @@
+package Log
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memStorage keeps a log's files in memory.
+type memStorage struct {
+	mu     sync.Mutex
+	files  map[string]*memFile
+	locked bool
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string]*memFile)}
+}
+
+func (m *memStorage) Open(name string, flag int) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		f = &memFile{name: name}
+		m.files[name] = f
+	} else if flag&os.O_TRUNC != 0 {
+		f.Truncate(0)
+	}
+	return f, nil
+}
+
+func (m *memStorage) List() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.files {
+		if !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memStorage) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[oldname]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldname)
+	f.mu.Lock()
+	f.name = newname
+	f.mu.Unlock()
+	m.files[newname] = f
+	return nil
+}
+
+func (m *memStorage) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memStorage) RemoveAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files = make(map[string]*memFile)
+	return nil
+}
+
+// Lock keeps a second Log from writing to the same storage. Memory
+// storage is never shared between processes, so the holder is always this
+// process.
+func (m *memStorage) Lock() (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locked {
+		return nil, ErrLogLocked{Dir: "memory", PID: os.Getpid()}
+	}
+	m.locked = true
+	return memLock{m}, nil
+}
+
+type memLock struct {
+	m *memStorage
+}
+
+func (l memLock) Close() error {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	l.m.locked = false
+	return nil
+}
+
+// memFile is a file of memStorage. Its Map returns the file's own bytes,
+// so writes to the mapping are writes to the file.
+type memFile struct {
+	mu   sync.RWMutex
+	name string
+	data []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := int(off) + len(p); end > len(f.data) {
+		f.grow(end)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) Append(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+// grow extends data to size with zeros. Callers hold mu.
+func (f *memFile) grow(size int) {
+	if size <= cap(f.data) {
+		f.data = f.data[:size]
+		return
+	}
+	data := make([]byte, size, max(size, 2*cap(f.data)))
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if int(size) > len(f.data) {
+		f.grow(int(size))
+		return nil
+	}
+	// Zero what's cut off, since growing again reuses it.
+	clear(f.data[size:])
+	f.data = f.data[:size]
+	return nil
+}
+
+func (f *memFile) Size() (uint64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return uint64(len(f.data)), nil
+}
+
+func (f *memFile) Map(writable bool) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.data, nil
+}
+
+func (f *memFile) Unmap() error { return nil }
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+func (f *memFile) Name() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.name
+}
@@ -1,10 +1,10 @@
 package Log
 
 import (
-	"bufio"
 	"encoding/binary"
-	"os"
+	"io"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -13,75 +13,119 @@ var (
 
 const (
 	lenWidth = 8
+	// bufferSize is how many appended bytes are kept in memory before
+	// they are written to the file.
+	bufferSize = 4096
 )
 
+// store is an append-only file of length-prefixed records. Appends are
+// buffered in buf; readers see buffered bytes without flushing them, and
+// read bytes already in the file with pread without taking any lock, so
+// consumers read in parallel with each other and with the producer.
 type store struct {
-	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
+	File
+	// mu guards buf and size. Writers hold it, and so do readers of
+	// bytes that are still in buf.
+	mu   sync.RWMutex
+	buf  []byte
 	size uint64
+	// flushed is how many bytes are in the file. Bytes below it never
+	// change.
+	flushed atomic.Uint64
 }
 
-func newStore(f *os.File) (*store, error) {
-	fi, err := os.Stat(f.Name())
+func newStore(f File) (*store, error) {
+	size, err := f.Size()
 	if err != nil {
 		return nil, err
 	}
-	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
 		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+		buf:  make([]byte, 0, bufferSize),
+	}
+	s.flushed.Store(size)
+	return s, nil
 }
 
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
-		return 0, 0, err
-	}
-	w, err := s.buf.Write(p)
-	if err != nil {
-		return 0, 0, err
+	s.buf = enc.AppendUint64(s.buf, uint64(len(p)))
+	s.buf = append(s.buf, p...)
+	w := uint64(lenWidth + len(p))
+	s.size += w
+	if len(s.buf) >= bufferSize {
+		if err := s.flush(); err != nil {
+			return 0, 0, err
+		}
 	}
+	return w, pos, nil
+}
 
-	w += lenWidth
-	s.size += uint64(w)
-	return uint64(w), pos, nil
+// flush writes buf to the file. Callers hold mu for writing.
+func (s *store) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	n, err := s.File.Append(s.buf)
+	// Whatever was appended stays appended even on error.
+	s.flushed.Add(uint64(n))
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+	return err
 }
 
-func (s *store) Read(pos uint64) ([]byte, error) {
+func (s *store) Flush() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
-	}
+	return s.flush()
+}
+
+func (s *store) Read(pos uint64) ([]byte, error) {
 	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	if _, err := s.ReadAt(size, int64(pos)); err != nil {
 		return nil, err
 	}
 	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	if _, err := s.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
+	if uint64(off)+uint64(len(p)) <= s.flushed.Load() {
+		return s.File.ReadAt(p, off)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// A flush may have landed since the check above, and flushed can't
+	// change while mu is held, so the split is decided again from here.
+	flushed := s.flushed.Load()
+	n := 0
+	if uint64(off) < flushed {
+		m, err := s.File.ReadAt(p[:min(uint64(len(p)), flushed-uint64(off))], off)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		if start := uint64(off) + uint64(n) - flushed; start < uint64(len(s.buf)) {
+			n += copy(p[n:], s.buf[start:])
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
 	}
-	return s.File.ReadAt(p, off)
+	return n, nil
 }
 
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.buf.Flush()
+	err := s.flush()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,228 @@
+package Log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t testing.TB) *store {
+	t.Helper()
+	f, err := os.OpenFile(
+		filepath.Join(t.TempDir(), "test.store"),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	require.NoError(t, err)
+	s, err := newStore(osFile{f})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStoreReadsUnflushed(t *testing.T) {
+	s := newTestStore(t)
+	var positions []uint64
+	var want [][]byte
+	// Enough records for several flushes, the last ones still buffered.
+	for i := 0; len(want) == 0 || s.flushed.Load() < 3*bufferSize; i++ {
+		p := bytes.Repeat([]byte{byte(i)}, 100+i%50)
+		_, pos, err := s.Append(p)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+		want = append(want, p)
+	}
+	_, pos, err := s.Append([]byte("buffered"))
+	require.NoError(t, err)
+	positions = append(positions, pos)
+	want = append(want, []byte("buffered"))
+	require.Less(t, s.flushed.Load(), s.size)
+
+	for i, pos := range positions {
+		got, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, want[i], got)
+	}
+
+	// A ReadAt spanning the file and the buffer, and one past the end.
+	all := make([]byte, s.size)
+	n, err := s.ReadAt(all, 0)
+	require.NoError(t, err)
+	require.Equal(t, int(s.size), n)
+	n, err = s.ReadAt(make([]byte, 10), int64(s.size-4))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 4, n)
+
+	// Reading didn't flush.
+	require.Less(t, s.flushed.Load(), s.size)
+	require.NoError(t, s.Flush())
+	require.Equal(t, s.size, s.flushed.Load())
+	got, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, []byte("buffered"), got)
+}
+
+// TestStoreConcurrentReadWrite is meant for the race detector: readers
+// keep reading records, buffered or not, while a writer appends.
+func TestStoreConcurrentReadWrite(t *testing.T) {
+	s := newTestStore(t)
+	const records = 2000
+	positions := make([]uint64, records)
+	var appended atomic.Int64
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < records; i++ {
+			_, pos, err := s.Append([]byte(fmt.Sprintf("record-%d", i)))
+			require.NoError(t, err)
+			positions[i] = pos
+			appended.Store(int64(i + 1))
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; appended.Load() < records || i < records; i++ {
+				n := appended.Load()
+				if n == 0 {
+					continue
+				}
+				j := int64(i) % n
+				got, err := s.Read(positions[j])
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("record-%d", j), string(got))
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+// TestStoreReadAcrossFlush reads ranges ending just past the flushed end
+// of the file while flushes land between a read's check of the file and
+// its taking the lock.
+func TestStoreReadAcrossFlush(t *testing.T) {
+	s := newTestStore(t)
+	var want []byte
+	for i := 0; len(want) < 200*bufferSize; i++ {
+		p := []byte(fmt.Sprintf("record-%d", i))
+		want = enc.AppendUint64(want, uint64(len(p)))
+		want = append(want, p...)
+	}
+	var size atomic.Uint64
+	appendNext := func() {
+		pos := size.Load()
+		n := enc.Uint64(want[pos:])
+		w, _, err := s.Append(want[pos+lenWidth : pos+lenWidth+n])
+		require.NoError(t, err)
+		size.Store(pos + w)
+	}
+
+	// One read held up by a flush in progress.
+	for s.flushed.Load() < 60 || s.size < s.flushed.Load()+4 {
+		appendNext()
+	}
+	off := s.flushed.Load() - 60
+	p := make([]byte, 64)
+	s.mu.Lock()
+	read := make(chan error)
+	go func() {
+		_, err := s.ReadAt(p, int64(off))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, s.flush())
+	s.mu.Unlock()
+	require.NoError(t, <-read)
+	require.Equal(t, want[off:off+64], p)
+
+	// And many while appending.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for size.Load() < uint64(len(want)) {
+			appendNext()
+		}
+	}()
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, 64)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				flushed := s.flushed.Load()
+				if flushed < 60 || flushed+4 > size.Load() {
+					continue
+				}
+				off := flushed - 60
+				n, err := s.ReadAt(p, int64(off))
+				require.NoError(t, err)
+				require.Equal(t, want[off:off+uint64(n)], p[:n])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkStoreReadWrite(b *testing.B) {
+	record := bytes.Repeat([]byte("a"), 256)
+	for _, readers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			s := newTestStore(b)
+			var positions []uint64
+			for i := 0; i < 1000; i++ {
+				_, pos, err := s.Append(record)
+				require.NoError(b, err)
+				positions = append(positions, pos)
+			}
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			var writes atomic.Int64
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, _, err := s.Append(record); err != nil {
+						panic(err)
+					}
+					writes.Add(1)
+				}
+			}()
+			b.SetParallelism(readers)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, err := s.Read(positions[i%len(positions)]); err != nil {
+						panic(err)
+					}
+					i++
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-done
+			b.ReportMetric(float64(writes.Load())/b.Elapsed().Seconds(), "writes/s")
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package Log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "Proyecto/api/v1"
+)
+
+// tierCache is the subdirectory of the log that offloaded segments are
+// fetched into.
+const tierCache = "tier-cache"
+
+// offloadedFile marks a log that has removed segments locally after
+// uploading them, so a log opened without its object store knows they're
+// missing.
+const offloadedFile = "OFFLOADED"
+
+// Tiering configures offloading closed segments to an object store.
+type Tiering struct {
+	// Store enables tiering when set.
+	Store ObjectStore
+	// Prefix, required with Store, starts the keys of the log's objects,
+	// so logs can share a Store. It can't hold slashes or dots.
+	Prefix string
+	// LocalRetention is how long a closed segment stays on local disk
+	// once uploaded, counted from when the log rolled over to the next
+	// segment, or from when it was opened for older segments.
+	LocalRetention time.Duration
+	// CacheSegments is how many offloaded segments are kept fetched for
+	// reads; 4 when zero.
+	CacheSegments int
+	// Interval between tiering passes in the background. When zero,
+	// passes only run when Log.Tier is called.
+	Interval time.Duration
+	// OnError, when set, is called with the errors of background passes.
+	// A failed pass is retried at the next interval.
+	OnError func(error)
+}
+
+// remoteSegment is a segment whose files are only in the object store.
+type remoteSegment struct {
+	baseOffset, nextOffset uint64
+}
+
+// tier fetches offloaded segments into a local cache and runs the
+// background passes.
+type tier struct {
+	Tiering
+	config Config
+	cache  Storage
+	// offloaded is whether offloadedFile is in the log, guarded by the
+	// log's mu.
+	offloaded bool
+
+	// mu guards fetched, most recently used last, and fetching, the
+	// downloads under way by base offset.
+	mu       sync.Mutex
+	fetched  []*segment
+	fetching map[uint64]*fetchCall
+
+	// pass serializes tiering passes.
+	pass sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fetchCall is a download of an offloaded segment, waited on by every
+// read of the segment until done is closed.
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newTier(l *Log) (*tier, error) {
+	t := &tier{
+		Tiering:  l.Config.Tiering,
+		fetching: make(map[uint64]*fetchCall),
+	}
+	if t.Prefix == "" || strings.ContainsAny(t.Prefix, `/\.`) {
+		return nil, fmt.Errorf("invalid tiering prefix %q", t.Prefix)
+	}
+	if t.CacheSegments <= 0 {
+		t.CacheSegments = 4
+	}
+	// Fetched segments are read-only copies and never tiered themselves.
+	t.config = l.Config
+	t.config.ReadOnly = true
+	t.config.Tiering = Tiering{}
+	switch st := l.storage.(type) {
+	case *dirStorage:
+		// A read-only log gets its own cache, not to step on the
+		// writer's.
+		dir := path.Join(st.dir, tierCache, "rw")
+		if l.Config.ReadOnly {
+			dir = path.Join(st.dir, tierCache, "ro-"+strconv.Itoa(os.Getpid()))
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		t.cache = &dirStorage{dir: dir, mmap: st.mmap}
+	default:
+		t.cache = newMemStorage()
+	}
+	return t, nil
+}
+
+// key returns the object key of r's file with extension ext.
+func (t *tier) key(r remoteSegment, ext string) string {
+	return fmt.Sprintf("%s.%d-%d%s", t.Prefix, r.baseOffset, r.nextOffset, ext)
+}
+
+// parseKey parses a key made by key, failing for other logs' keys.
+func (t *tier) parseKey(key string) (remoteSegment, string, bool) {
+	key, ok := strings.CutPrefix(key, t.Prefix+".")
+	if !ok {
+		return remoteSegment{}, "", false
+	}
+	ext := path.Ext(key)
+	base, next, ok := strings.Cut(strings.TrimSuffix(key, ext), "-")
+	if !ok || (ext != ".store" && ext != ".index") {
+		return remoteSegment{}, "", false
+	}
+	r := remoteSegment{}
+	var err error
+	if r.baseOffset, err = strconv.ParseUint(base, 10, 64); err != nil {
+		return remoteSegment{}, "", false
+	}
+	if r.nextOffset, err = strconv.ParseUint(next, 10, 64); err != nil {
+		return remoteSegment{}, "", false
+	}
+	return r, ext, true
+}
+
+// loadRemote lists the offloaded segments. Local segments already in the
+// object store are marked as uploaded; the others become l.remote.
+// Segments are uploaded index first, so a store key means both are there.
+func (l *Log) loadRemote() error {
+	keys, err := l.tier.Store.List()
+	if err != nil {
+		return err
+	}
+	local := make(map[uint64]*segment, len(l.segments))
+	for _, s := range l.segments {
+		local[s.baseOffset] = s
+	}
+	now := time.Now()
+	l.remote = nil
+	for _, key := range keys {
+		r, ext, ok := l.tier.parseKey(key)
+		if !ok || ext != ".store" {
+			continue
+		}
+		if s, ok := local[r.baseOffset]; ok {
+			if s.nextOffset == r.nextOffset && s != l.activeSegment {
+				s.uploaded = true
+				s.closedAt = now
+			}
+			continue
+		}
+		l.remote = append(l.remote, r)
+	}
+	sort.Slice(l.remote, func(i, j int) bool {
+		return l.remote[i].baseOffset < l.remote[j].baseOffset
+	})
+	return nil
+}
+
+// remoteFor returns the offloaded segment holding off. Callers hold l.mu.
+func (l *Log) remoteFor(off uint64) (remoteSegment, bool) {
+	i := sort.Search(len(l.remote), func(i int) bool {
+		return off < l.remote[i].nextOffset
+	})
+	if i == len(l.remote) || off < l.remote[i].baseOffset {
+		return remoteSegment{}, false
+	}
+	return l.remote[i], true
+}
+
+// Tier uploads the closed segments that aren't in the object store yet
+// and removes the local copies of uploaded segments older than
+// LocalRetention. Background passes call it every Interval.
+func (l *Log) Tier() error {
+	if l.tier == nil {
+		return errors.New("tiering is not configured")
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.tier.pass.Lock()
+	defer l.tier.pass.Unlock()
+
+	l.mu.RLock()
+	var pending []*segment
+	for _, s := range l.segments {
+		if s != l.activeSegment && !s.uploaded {
+			pending = append(pending, s)
+		}
+	}
+	l.mu.RUnlock()
+	for _, s := range pending {
+		if err := l.upload(s); err != nil {
+			return err
+		}
+	}
+	return l.offload(time.Now())
+}
+
+func (l *Log) hasSegment(s *segment) bool {
+	for _, t := range l.segments {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Log) upload(s *segment) error {
+	l.mu.RLock()
+	if !l.hasSegment(s) {
+		l.mu.RUnlock()
+		return nil
+	}
+	store, index, err := s.contents()
+	l.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	r := remoteSegment{s.baseOffset, s.nextOffset}
+	if err := l.tier.Store.Put(l.tier.key(r, ".index"), bytes.NewReader(index)); err != nil {
+		return err
+	}
+	if err := l.tier.Store.Put(l.tier.key(r, ".store"), bytes.NewReader(store)); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.hasSegment(s) {
+		// Truncated while uploading.
+		return l.tier.delete(r)
+	}
+	s.uploaded = true
+	return nil
+}
+
+// offload removes the local copies of uploaded segments closed for at
+// least LocalRetention.
+func (l *Log) offload(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []*segment
+	for i, s := range l.segments {
+		if !s.uploaded || now.Sub(s.closedAt) < l.tier.LocalRetention {
+			segments = append(segments, s)
+			continue
+		}
+		if !l.tier.offloaded {
+			if err := writeFileAtomic(l.storage, offloadedFile, nil); err != nil {
+				l.segments = append(segments, l.segments[i:]...)
+				return err
+			}
+			l.tier.offloaded = true
+		}
+		if err := s.Remove(); err != nil {
+			l.segments = append(segments, l.segments[i:]...)
+			return err
+		}
+		l.remote = append(l.remote, remoteSegment{s.baseOffset, s.nextOffset})
+	}
+	l.segments = segments
+	sort.Slice(l.remote, func(i, j int) bool {
+		return l.remote[i].baseOffset < l.remote[j].baseOffset
+	})
+	l.lastRead.Store(nil)
+	return nil
+}
+
+// contents returns the bytes of the segment's store and index files.
+func (s *segment) contents() (store, index []byte, err error) {
+	if err := s.store.Flush(); err != nil {
+		return nil, nil, err
+	}
+	store = make([]byte, s.store.size)
+	if _, err := s.store.ReadAt(store, 0); err != nil {
+		return nil, nil, err
+	}
+	index = make([]byte, headerWidth+s.index.size)
+	if s.index.mmap != nil {
+		copy(index, s.index.mmap)
+	} else if _, err := s.index.file.ReadAt(index, 0); err != nil {
+		return nil, nil, err
+	}
+	return store, index, nil
+}
+
+// read reads off from the offloaded segment r, fetching it if it isn't
+// cached. Downloads run outside t.mu, one per segment, so reads of other
+// segments go on meanwhile.
+func (t *tier) read(r remoteSegment, off uint64) (*api.Record, error) {
+	t.mu.Lock()
+	for {
+		if s := t.cached(r); s != nil {
+			defer t.mu.Unlock()
+			return s.Read(off)
+		}
+		call, ok := t.fetching[r.baseOffset]
+		if !ok {
+			call = &fetchCall{done: make(chan struct{})}
+			t.fetching[r.baseOffset] = call
+			t.mu.Unlock()
+			call.err = t.download(r)
+			t.mu.Lock()
+			if call.err == nil {
+				call.err = t.open(r)
+			}
+			delete(t.fetching, r.baseOffset)
+			close(call.done)
+		} else {
+			t.mu.Unlock()
+			<-call.done
+			t.mu.Lock()
+		}
+		if call.err != nil {
+			t.mu.Unlock()
+			return nil, call.err
+		}
+	}
+}
+
+// cached returns the cached copy of r, marking it most recently used, or
+// nil. Callers hold t.mu.
+func (t *tier) cached(r remoteSegment) *segment {
+	for i, s := range t.fetched {
+		if s.baseOffset == r.baseOffset {
+			t.fetched = append(append(t.fetched[:i:i], t.fetched[i+1:]...), s)
+			return s
+		}
+	}
+	return nil
+}
+
+// download writes r's files into the cache.
+func (t *tier) download(r remoteSegment) error {
+	for _, ext := range []string{".index", ".store"} {
+		b, err := t.get(t.key(r, ext))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(t.cache, segmentFile(r.baseOffset, ext), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open opens the downloaded copy of r, evicting the least recently used
+// copy. Callers hold t.mu.
+func (t *tier) open(r remoteSegment) error {
+	s, err := newSegment(t.cache, r.baseOffset, t.config)
+	if err != nil {
+		return err
+	}
+	t.fetched = append(t.fetched, s)
+	if len(t.fetched) > t.CacheSegments {
+		evicted := t.fetched[0]
+		t.fetched = t.fetched[1:]
+		return t.removeCached(evicted)
+	}
+	return nil
+}
+
+func (t *tier) get(key string) ([]byte, error) {
+	rc, err := t.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// contents returns the bytes of r's store and index files.
+func (t *tier) contents(r remoteSegment) (store, index []byte, err error) {
+	if store, err = t.get(t.key(r, ".store")); err != nil {
+		return nil, nil, err
+	}
+	if index, err = t.get(t.key(r, ".index")); err != nil {
+		return nil, nil, err
+	}
+	return store, index, nil
+}
+
+func (t *tier) removeCached(s *segment) error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if err := t.cache.Remove(segmentFile(s.baseOffset, ".index")); err != nil {
+		return err
+	}
+	return t.cache.Remove(segmentFile(s.baseOffset, ".store"))
+}
+
+// delete removes r from the object store and the cache.
+func (t *tier) delete(r remoteSegment) error {
+	t.mu.Lock()
+	for i, s := range t.fetched {
+		if s.baseOffset == r.baseOffset {
+			t.fetched = append(t.fetched[:i:i], t.fetched[i+1:]...)
+			if err := t.removeCached(s); err != nil {
+				t.mu.Unlock()
+				return err
+			}
+			break
+		}
+	}
+	t.mu.Unlock()
+	if err := t.Store.Delete(t.key(r, ".store")); err != nil {
+		return err
+	}
+	return t.Store.Delete(t.key(r, ".index"))
+}
+
+func (t *tier) start(l *Log) {
+	if t.Interval <= 0 {
+		return
+	}
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(t.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				if err := l.Tier(); err != nil && t.OnError != nil {
+					t.OnError(err)
+				}
+			}
+		}
+	}()
+}
+
+// close stops the background passes and drops the cache.
+func (t *tier) close() error {
+	if t.stop != nil {
+		close(t.stop)
+		<-t.done
+		t.stop = nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.fetched {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	t.fetched = nil
+	return t.cache.RemoveAll()
+}
@@ -0,0 +1,271 @@
+package Log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "Proyecto/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the objects put into and fetched from a store.
+type countingStore struct {
+	ObjectStore
+	puts, gets atomic.Int32
+}
+
+func (c *countingStore) Put(key string, r io.Reader) error {
+	c.puts.Add(1)
+	return c.ObjectStore.Put(key, r)
+}
+
+func (c *countingStore) Get(key string) (io.ReadCloser, error) {
+	c.gets.Add(1)
+	return c.ObjectStore.Get(key)
+}
+
+func newTieredLog(t *testing.T, dir string, tiering Tiering) *Log {
+	t.Helper()
+	c := Config{Tiering: tiering}
+	// Three records per segment.
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	return l
+}
+
+func requireRange(t *testing.T, l *Log, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		record, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), string(record.Value))
+	}
+}
+
+func TestTiering(t *testing.T) {
+	dir := t.TempDir()
+	objects, err := NewDirObjectStore(t.TempDir())
+	require.NoError(t, err)
+	store := &countingStore{ObjectStore: objects}
+	tiering := Tiering{Store: store, Prefix: "log", CacheSegments: 1}
+
+	l := newTieredLog(t, dir, tiering)
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, l.SegmentCount())
+	require.NoError(t, l.Tier())
+	// The closed segments are offloaded; the active one stays.
+	require.Equal(t, 1, l.SegmentCount())
+	keys, err := objects.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"log.0-3.index", "log.0-3.store", "log.3-6.index", "log.3-6.store", "log.6-9.index", "log.6-9.store",
+	}, keys)
+	_, err = os.Stat(path.Join(dir, "0.store"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Offloaded segments are fetched on demand and cached.
+	requireRange(t, l, 0, 10)
+	require.Equal(t, int32(6), store.gets.Load())
+	requireRange(t, l, 6, 9)
+	require.Equal(t, int32(6), store.gets.Load())
+	requireRange(t, l, 0, 3)
+	require.Equal(t, int32(8), store.gets.Load())
+	low, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), low)
+
+	// Snapshots include the offloaded segments.
+	var snapshot bytes.Buffer
+	_, err = l.Snapshot(&snapshot)
+	require.NoError(t, err)
+	restoreDir := t.TempDir()
+	_, err = RestoreLog(restoreDir, &snapshot)
+	require.NoError(t, err)
+	restored, err := NewLog(restoreDir, Config{})
+	require.NoError(t, err)
+	requireRange(t, restored, 0, 10)
+	require.NoError(t, restored.Close())
+
+	// Nothing is uploaded twice.
+	require.NoError(t, l.Tier())
+	require.Equal(t, int32(6), store.puts.Load())
+	require.NoError(t, l.Close())
+
+	l = newTieredLog(t, dir, tiering)
+	require.Equal(t, Recovery{}, l.Recovery())
+	requireRange(t, l, 0, 10)
+	off, err := l.Append(&api.Record{Value: []byte("10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	// Truncating drops offloaded segments too.
+	require.NoError(t, l.Truncate(4))
+	keys, err = objects.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"log.3-6.index", "log.3-6.store", "log.6-9.index", "log.6-9.store"}, keys)
+	low, err = l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), low)
+	_, err = l.Read(2)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.NoError(t, l.Close())
+
+	// The local cache is gone with the log.
+	_, err = os.Stat(path.Join(dir, tierCache, "rw"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Opened without its store, the log knows it's missing segments.
+	ro, err := NewLog(dir, Config{ReadOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, Recovery{Offloaded: true}, ro.Recovery())
+	require.NoError(t, ro.Close())
+}
+
+func TestTieringRetention(t *testing.T) {
+	dir := t.TempDir()
+	objects, err := NewDirObjectStore(t.TempDir())
+	require.NoError(t, err)
+	store := &countingStore{ObjectStore: objects}
+
+	l := newTieredLog(t, dir, Tiering{Store: store, Prefix: "log", LocalRetention: time.Hour})
+	for i := 0; i < 7; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Tier())
+	require.Equal(t, int32(4), store.puts.Load())
+	require.Equal(t, 3, l.SegmentCount())
+	require.NoError(t, l.Close())
+
+	// Uploaded but still local, the segments don't need the store.
+	ro, err := NewLog(dir, Config{ReadOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, Recovery{}, ro.Recovery())
+	require.NoError(t, ro.Close())
+
+	// Reopened, the segments are known to be uploaded already.
+	l = newTieredLog(t, dir, Tiering{Store: store, Prefix: "log", LocalRetention: time.Hour})
+	require.NoError(t, l.Tier())
+	require.Equal(t, int32(4), store.puts.Load())
+	require.Equal(t, 3, l.SegmentCount())
+
+	// A rebuilt index keeps the segment uploaded and inside its retention.
+	require.NoError(t, l.RebuildIndex(0))
+	require.NoError(t, l.Tier())
+	require.Equal(t, int32(4), store.puts.Load())
+	require.NoError(t, l.offload(time.Now()))
+	require.Equal(t, 3, l.SegmentCount())
+	require.NoError(t, l.offload(time.Now().Add(time.Hour)))
+	require.Equal(t, 1, l.SegmentCount())
+	requireRange(t, l, 0, 7)
+
+	// Once every offloaded segment is truncated, the log is whole again.
+	require.NoError(t, l.Truncate(5))
+	require.NoError(t, l.Close())
+	ro, err = NewLog(dir, Config{ReadOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, Recovery{}, ro.Recovery())
+	requireRange(t, ro, 6, 7)
+	require.NoError(t, ro.Close())
+}
+
+func TestTieringInBackground(t *testing.T) {
+	objects, err := NewDirObjectStore(t.TempDir())
+	require.NoError(t, err)
+	l := newTieredLog(t, t.TempDir(), Tiering{
+		Store:    objects,
+		Prefix:   "log",
+		Interval: 10 * time.Millisecond,
+		OnError:  func(err error) { t.Error(err) },
+	})
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return l.SegmentCount() == 1
+	}, time.Second, 10*time.Millisecond)
+	requireRange(t, l, 0, 10)
+}
+
+func TestTieringSharedStore(t *testing.T) {
+	objects, err := NewDirObjectStore(t.TempDir())
+	require.NoError(t, err)
+	_, err = NewLog(t.TempDir(), Config{Tiering: Tiering{Store: objects}})
+	require.Error(t, err)
+
+	// Logs with the same offsets keep their own objects.
+	var logs []*Log
+	for _, prefix := range []string{"a", "b"} {
+		l := newTieredLog(t, t.TempDir(), Tiering{Store: objects, Prefix: prefix})
+		for i := 0; i < 7; i++ {
+			_, err := l.Append(&api.Record{Value: []byte(prefix + fmt.Sprint(i))})
+			require.NoError(t, err)
+		}
+		require.NoError(t, l.Tier())
+		logs = append(logs, l)
+	}
+	for i, prefix := range []string{"a", "b"} {
+		record, err := logs[i].Read(1)
+		require.NoError(t, err)
+		require.Equal(t, prefix+"1", string(record.Value))
+		require.NoError(t, logs[i].Close())
+	}
+}
+
+// blockingStore holds Gets of the keys in blocked until release is closed.
+type blockingStore struct {
+	ObjectStore
+	blocked map[string]bool
+	release chan struct{}
+}
+
+func (b *blockingStore) Get(key string) (io.ReadCloser, error) {
+	if b.blocked[key] {
+		<-b.release
+	}
+	return b.ObjectStore.Get(key)
+}
+
+func TestTieringConcurrentFetches(t *testing.T) {
+	objects, err := NewDirObjectStore(t.TempDir())
+	require.NoError(t, err)
+	store := &blockingStore{
+		ObjectStore: objects,
+		blocked:     map[string]bool{"log.0-3.index": true},
+		release:     make(chan struct{}),
+	}
+	l := newTieredLog(t, t.TempDir(), Tiering{Store: store, Prefix: "log"})
+	defer l.Close()
+	for i := 0; i < 7; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Tier())
+
+	// Two reads wait on the one slow download, while another segment
+	// is read.
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := l.Read(uint64(i))
+			done <- err
+		}()
+	}
+	requireRange(t, l, 3, 6)
+	close(store.release)
+	require.NoError(t, <-done)
+	require.NoError(t, <-done)
+}
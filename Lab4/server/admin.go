@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+
+	api "Proyecto/api/v1"
+	"Proyecto/auth"
+)
+
+// PolicyAdmin changes the ACL at runtime. auth.Authorizer implements it.
+type PolicyAdmin interface {
+	AddPolicy(p auth.Policy) (bool, error)
+	RemovePolicy(p auth.Policy) (bool, error)
+	AddRoleForUser(user, role string) (bool, error)
+	Policies() ([]auth.Policy, []auth.RoleAssignment)
+}
+
+var _ PolicyAdmin = (*auth.Authorizer)(nil)
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+type adminServer struct {
+	api.UnimplementedAdminServer
+	srv *grpcServer
+}
+
+func (s *adminServer) AddPolicy(ctx context.Context, req *api.AddPolicyRequest) (*api.AddPolicyResponse, error) {
+	if err := s.srv.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	added, err := s.srv.PolicyAdmin.AddPolicy(policyFromProto(req.Policy))
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddPolicyResponse{Added: added}, nil
+}
+
+func (s *adminServer) RemovePolicy(ctx context.Context, req *api.RemovePolicyRequest) (*api.RemovePolicyResponse, error) {
+	if err := s.srv.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	removed, err := s.srv.PolicyAdmin.RemovePolicy(policyFromProto(req.Policy))
+	if err != nil {
+		return nil, err
+	}
+	return &api.RemovePolicyResponse{Removed: removed}, nil
+}
+
+func (s *adminServer) ListPolicies(ctx context.Context, req *api.ListPoliciesRequest) (*api.ListPoliciesResponse, error) {
+	if err := s.srv.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	policies, roles := s.srv.PolicyAdmin.Policies()
+	res := &api.ListPoliciesResponse{}
+	for _, p := range policies {
+		res.Policies = append(res.Policies, &api.Policy{
+			Subject: p.Subject,
+			Object:  p.Object,
+			Action:  p.Action,
+			Effect:  p.Effect,
+		})
+	}
+	for _, r := range roles {
+		res.Roles = append(res.Roles, &api.RoleAssignment{User: r.User, Role: r.Role})
+	}
+	return res, nil
+}
+
+func (s *adminServer) AddRoleForUser(ctx context.Context, req *api.AddRoleForUserRequest) (*api.AddRoleForUserResponse, error) {
+	if err := s.srv.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	added, err := s.srv.PolicyAdmin.AddRoleForUser(req.User, req.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddRoleForUserResponse{Added: added}, nil
+}
+
+func policyFromProto(p *api.Policy) auth.Policy {
+	return auth.Policy{
+		Subject: p.GetSubject(),
+		Object:  p.GetObject(),
+		Action:  p.GetAction(),
+		Effect:  p.GetEffect(),
+	}
+}
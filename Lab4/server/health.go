@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	api "Proyecto/api/v1"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// ReadinessCheck returns nil when its part of the server can take traffic.
+type ReadinessCheck func() error
+
+// healthRefreshInterval is how often the checks are run for Watch
+// subscribers.
+const healthRefreshInterval = time.Second
+
+// Health serves grpc.health.v1 and the HTTP /healthz and /readyz probes.
+// Readiness is recomputed from the registered checks on every probe, and
+// every refreshInterval once anyone watches, and turns NOT_SERVING for
+// good once Shutdown is called.
+type Health struct {
+	*health.Server
+	refreshInterval time.Duration
+	refreshing      sync.Once
+	done            chan struct{}
+
+	mu       sync.Mutex
+	checks   map[string]ReadinessCheck
+	shutdown bool
+}
+
+func NewHealth() *Health {
+	return &Health{
+		Server:          health.NewServer(),
+		refreshInterval: healthRefreshInterval,
+		done:            make(chan struct{}),
+		checks:          make(map[string]ReadinessCheck),
+	}
+}
+
+// AddCheck registers a readiness check, e.g. one reporting that a clustered
+// node has joined.
+func (h *Health) AddCheck(name string, check ReadinessCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Ready runs every check and updates the gRPC serving status to match.
+func (h *Health) Ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return errShuttingDown
+	}
+	err := h.runChecks()
+	st := healthpb.HealthCheckResponse_SERVING
+	if err != nil {
+		st = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	h.SetServingStatus("", st)
+	h.SetServingStatus(api.Log_ServiceDesc.ServiceName, st)
+	return err
+}
+
+func (h *Health) runChecks() error {
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if err := h.checks[name](); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown marks every service NOT_SERVING; call it before GracefulStop so
+// load balancers stop sending new requests while in-flight ones drain.
+func (h *Health) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.shutdown {
+		h.shutdown = true
+		close(h.done)
+	}
+	h.Server.Shutdown()
+}
+
+func (h *Health) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	h.Ready()
+	return h.Server.Check(ctx, req)
+}
+
+// Watch streams the serving status, which is refreshed in the background
+// from the first Watch on, since watchers don't run the checks themselves.
+func (h *Health) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	h.refreshing.Do(func() { go h.refresh() })
+	h.Ready()
+	return h.Server.Watch(req, stream)
+}
+
+func (h *Health) refresh() {
+	ticker := time.NewTicker(h.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.Ready()
+		}
+	}
+}
+
+func (h *Health) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (h *Health) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.Ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -13,13 +13,22 @@ type HTTPServer struct {
 	Log *logpkg.Log
 }
 
-func NewHTTPServer(addr string, log *logpkg.Log) *http.Server {
+// NewHTTPServer also serves /metrics when metrics is not nil and the
+// /healthz and /readyz probes when health is not nil.
+func NewHTTPServer(addr string, log *logpkg.Log, metrics *Metrics, health *Health) *http.Server {
 	httpSrv := &HTTPServer{
 		Log: log,
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/produce", httpSrv.handleProduce)
 	mux.HandleFunc("/consume", httpSrv.handleConsume)
+	if metrics != nil {
+		mux.Handle("/metrics", metrics.Handler())
+	}
+	if health != nil {
+		mux.HandleFunc("/healthz", health.handleHealthz)
+		mux.HandleFunc("/readyz", health.handleReadyz)
+	}
 
 	return &http.Server{
 		Addr:    addr,
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"Proyecto/auth"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// IdentitySource selects which field of the client certificate names the
+// subject passed to the Authorizer.
+type IdentitySource string
+
+const (
+	IdentityCommonName IdentitySource = "cn"
+	IdentityDNSSAN     IdentitySource = "dns"
+	IdentityEmailSAN   IdentitySource = "email"
+	IdentitySPIFFE     IdentitySource = "spiffe"
+)
+
+func ParseIdentitySource(s string) (IdentitySource, error) {
+	switch src := IdentitySource(s); src {
+	case "", IdentityCommonName:
+		return IdentityCommonName, nil
+	case IdentityDNSSAN, IdentityEmailSAN, IdentitySPIFFE:
+		return src, nil
+	}
+	return "", fmt.Errorf("unknown identity source %q", s)
+}
+
+// Authenticator identifies the caller of an RPC. It returns an error
+// satisfying IsNoCredentials when the caller presented no credentials of
+// the kind it handles, so another Authenticator may be tried.
+type Authenticator func(ctx context.Context) (auth.Identity, error)
+
+// TLSAuthenticator reads the identity from the verified client
+// certificate. Groups come from the certificate's OU, so a policy or
+// quota naming a group only makes sense for certificates issued with
+// distinct OUs; CA/client-csr.json sets none, and every client issued
+// from it would share the same one otherwise.
+func TLSAuthenticator(source IdentitySource) Authenticator {
+	return func(ctx context.Context) (auth.Identity, error) {
+		peer, ok := peer.FromContext(ctx)
+		if !ok {
+			return auth.Identity{}, status.New(
+				codes.Unknown,
+				"Can't find peer information",
+			).Err()
+		}
+		if peer.AuthInfo == nil {
+			return auth.Identity{}, noCredentials("No security on transport protocol")
+		}
+		tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo)
+		if !ok {
+			return auth.Identity{}, noCredentials(fmt.Sprintf(
+				"unsupported transport security %q",
+				peer.AuthInfo.AuthType(),
+			))
+		}
+		chains := tlsInfo.State.VerifiedChains
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return auth.Identity{}, noCredentials("no verified client certificate")
+		}
+		cert := chains[0][0]
+		var subject string
+		switch source {
+		case "", IdentityCommonName:
+			subject = cert.Subject.CommonName
+		case IdentityDNSSAN:
+			if len(cert.DNSNames) > 0 {
+				subject = cert.DNSNames[0]
+			}
+		case IdentityEmailSAN:
+			if len(cert.EmailAddresses) > 0 {
+				subject = cert.EmailAddresses[0]
+			}
+		case IdentitySPIFFE:
+			for _, u := range cert.URIs {
+				if u.Scheme == "spiffe" {
+					subject = u.String()
+					break
+				}
+			}
+		}
+		if subject == "" {
+			return auth.Identity{}, status.Errorf(
+				codes.Unauthenticated,
+				"client certificate has no %s identity",
+				source,
+			)
+		}
+		return auth.Identity{
+			Subject: subject,
+			Groups:  cert.Subject.OrganizationalUnit,
+		}, nil
+	}
+}
+
+// anyOf tries each Authenticator in turn until one finds credentials.
+func anyOf(authenticators ...Authenticator) Authenticator {
+	if len(authenticators) == 1 {
+		return authenticators[0]
+	}
+	return func(ctx context.Context) (auth.Identity, error) {
+		err := noCredentials("no credentials")
+		for _, a := range authenticators {
+			var id auth.Identity
+			if id, err = a(ctx); !IsNoCredentials(err) {
+				return id, err
+			}
+		}
+		return auth.Identity{}, err
+	}
+}
+
+// rejectRevoked fails callers whose verified client certificate chain
+// check rejects, whichever Authenticator would identify them.
+func rejectRevoked(identify Authenticator, check func([][]*x509.Certificate) error) Authenticator {
+	return func(ctx context.Context) (auth.Identity, error) {
+		if p, ok := peer.FromContext(ctx); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+				if err := check(tlsInfo.State.VerifiedChains); err != nil {
+					return auth.Identity{}, status.Error(codes.Unauthenticated, err.Error())
+				}
+			}
+		}
+		return identify(ctx)
+	}
+}
+
+type noCredentialsError string
+
+func noCredentials(msg string) error { return noCredentialsError(msg) }
+
+func (e noCredentialsError) Error() string { return string(e) }
+
+func (e noCredentialsError) GRPCStatus() *status.Status {
+	return status.New(codes.Unauthenticated, string(e))
+}
+
+// IsNoCredentials reports whether err means the caller presented no
+// credentials for an Authenticator.
+func IsNoCredentials(err error) bool {
+	var e noCredentialsError
+	return errors.As(err, &e)
+}
+
+func authenticator(identify Authenticator) func(context.Context) (context.Context, error) {
+	return func(ctx context.Context) (context.Context, error) {
+		id, err := identify(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		return context.WithValue(ctx, identityContextKey{}, id), nil
+	}
+}
+
+func identity(ctx context.Context) auth.Identity {
+	id, _ := ctx.Value(identityContextKey{}).(auth.Identity)
+	return id
+}
+
+func subject(ctx context.Context) string {
+	return identity(ctx).Subject
+}
+
+type identityContextKey struct{}
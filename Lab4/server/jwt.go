@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"Proyecto/auth"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// JWTConfig configures JWTAuthenticator.
+type JWTConfig struct {
+	// JWKSFile holds the JSON Web Key Set the tokens are signed with.
+	JWKSFile string
+	// Issuer and Audience are required; tokens must match both.
+	Issuer   string
+	Audience string
+	// SubjectClaim names the claim used as the subject; "sub" when empty.
+	SubjectClaim string
+	// GroupsClaim, when set, names a string or string array claim used
+	// as the identity's groups.
+	GroupsClaim string
+	// ClockSkew is the leeway allowed on exp, nbf and iat.
+	ClockSkew time.Duration
+}
+
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// JWTAuthenticator validates a bearer token from the "authorization"
+// metadata against the keys in cfg.JWKSFile. Tokens must carry an
+// expiry and match the configured issuer and audience.
+func JWTAuthenticator(cfg JWTConfig) (Authenticator, error) {
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, fmt.Errorf("JWT issuer and audience are required")
+	}
+	b, err := os.ReadFile(cfg.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS %q: %w", cfg.JWKSFile, err)
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("no keys in JWKS %q", cfg.JWKSFile)
+	}
+	if cfg.SubjectClaim == "" {
+		cfg.SubjectClaim = "sub"
+	}
+	expected := jwt.Expected{
+		Issuer:      cfg.Issuer,
+		AnyAudience: jwt.Audience{cfg.Audience},
+	}
+	return func(ctx context.Context) (auth.Identity, error) {
+		raw, err := bearerToken(ctx)
+		if err != nil {
+			return auth.Identity{}, err
+		}
+		tok, err := jwt.ParseSigned(raw, jwtAlgorithms)
+		if err != nil {
+			return auth.Identity{}, invalidToken(err)
+		}
+		var claims jwt.Claims
+		var custom map[string]interface{}
+		if err := tok.Claims(keys, &claims, &custom); err != nil {
+			return auth.Identity{}, invalidToken(err)
+		}
+		if claims.Expiry == nil {
+			return auth.Identity{}, invalidToken(fmt.Errorf("missing exp claim"))
+		}
+		if err := claims.ValidateWithLeeway(expected.WithTime(time.Now()), cfg.ClockSkew); err != nil {
+			return auth.Identity{}, invalidToken(err)
+		}
+		subject, _ := custom[cfg.SubjectClaim].(string)
+		if subject == "" {
+			return auth.Identity{}, invalidToken(fmt.Errorf("missing %s claim", cfg.SubjectClaim))
+		}
+		id := auth.Identity{Subject: subject}
+		if cfg.GroupsClaim != "" {
+			switch g := custom[cfg.GroupsClaim].(type) {
+			case string:
+				id.Groups = []string{g}
+			case []interface{}:
+				for _, v := range g {
+					if s, ok := v.(string); ok {
+						id.Groups = append(id.Groups, s)
+					}
+				}
+			}
+		}
+		return id, nil
+	}, nil
+}
+
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", noCredentials("no bearer token")
+	}
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", status.Error(codes.Unauthenticated, "malformed authorization header")
+	}
+	return token, nil
+}
+
+func invalidToken(err error) error {
+	return status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	api "Proyecto/api/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// unaryLogger logs each call. It runs after authenticate, so calls that
+// fail authentication aren't logged.
+func unaryLogger(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		attrs := requestAttrs(ctx, info.FullMethod, start, err)
+		if off, ok := requestOffset(req, res); ok {
+			attrs = append(attrs, slog.Uint64("offset", off))
+		}
+		logger.LogAttrs(ctx, logLevel(err), "rpc", attrs...)
+		return res, err
+	}
+}
+
+func streamLogger(logger *slog.Logger) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		ctx := ss.Context()
+		logger.LogAttrs(ctx, logLevel(err), "rpc",
+			requestAttrs(ctx, info.FullMethod, start, err)...,
+		)
+		return err
+	}
+}
+
+func requestAttrs(ctx context.Context, method string, start time.Time, err error) []slog.Attr {
+	return []slog.Attr{
+		slog.String("method", method),
+		slog.String("subject", subject(ctx)),
+		slog.Duration("duration", time.Since(start)),
+		slog.String("status", status.Code(err).String()),
+	}
+}
+
+func requestOffset(req, res interface{}) (uint64, bool) {
+	if r, ok := res.(*api.ProduceResponse); ok && r != nil {
+		return r.Offset, true
+	}
+	if r, ok := req.(*api.ConsumeRequest); ok {
+		return r.Offset, true
+	}
+	return 0, false
+}
+
+func logLevel(err error) slog.Level {
+	if err != nil {
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	rpcs           *prometheus.CounterVec
+	rpcDuration    *prometheus.HistogramVec
+	appendDuration prometheus.Histogram
+	readDuration   prometheus.Histogram
+	subscribers    prometheus.Gauge
+	authDenials    *prometheus.CounterVec
+}
+
+// NewMetrics creates the server metrics on their own registry so tests can
+// gather them in-process without touching the global one.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "RPCs completed on the server, by method and status code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Time spent handling RPCs, by method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+		appendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "log_append_seconds",
+			Help:    "Latency of Log.Append.",
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
+		}),
+		readDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "log_read_seconds",
+			Help:    "Latency of Log.Read.",
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
+		}),
+		subscribers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "log_consume_stream_subscribers",
+			Help: "Active ConsumeStream subscribers.",
+		}),
+		authDenials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_denials_total",
+			Help: "Requests denied by the authorizer, by action.",
+		}, []string{"action"}),
+	}
+	m.Registry.MustRegister(
+		m.rpcs,
+		m.rpcDuration,
+		m.appendDuration,
+		m.readDuration,
+		m.subscribers,
+		m.authDenials,
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// LogStats is implemented by logs that can report their layout on disk.
+type LogStats interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	SegmentCount() int
+	Size() uint64
+}
+
+// RegisterLog exports gauges that are read from l on every scrape.
+func (m *Metrics) RegisterLog(l LogStats) error {
+	return m.Registry.Register(&logCollector{log: l})
+}
+
+func (m *Metrics) unaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	m.observeRPC(info.FullMethod, start, err)
+	return res, err
+}
+
+func (m *Metrics) streamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	m.observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+func (m *Metrics) observeRPC(method string, start time.Time, err error) {
+	m.rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	m.rpcs.WithLabelValues(method, status.Code(err).String()).Inc()
+}
+
+var (
+	segmentsDesc = prometheus.NewDesc(
+		"log_segments", "Segments in the log.", nil, nil,
+	)
+	sizeDesc = prometheus.NewDesc(
+		"log_size_bytes", "Bytes on disk used by store and index files.", nil, nil,
+	)
+	lowestOffsetDesc = prometheus.NewDesc(
+		"log_lowest_offset", "Lowest offset in the log.", nil, nil,
+	)
+	highestOffsetDesc = prometheus.NewDesc(
+		"log_highest_offset", "Highest offset in the log.", nil, nil,
+	)
+)
+
+type logCollector struct {
+	log LogStats
+}
+
+func (c *logCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- segmentsDesc
+	ch <- sizeDesc
+	ch <- lowestOffsetDesc
+	ch <- highestOffsetDesc
+}
+
+func (c *logCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(
+		segmentsDesc, prometheus.GaugeValue, float64(c.log.SegmentCount()),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		sizeDesc, prometheus.GaugeValue, float64(c.log.Size()),
+	)
+	if off, err := c.log.LowestOffset(); err == nil {
+		ch <- prometheus.MustNewConstMetric(
+			lowestOffsetDesc, prometheus.GaugeValue, float64(off),
+		)
+	}
+	if off, err := c.log.HighestOffset(); err == nil {
+		ch <- prometheus.MustNewConstMetric(
+			highestOffsetDesc, prometheus.GaugeValue, float64(off),
+		)
+	}
+}
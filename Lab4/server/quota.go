@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"Proyecto/auth"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// usageSaveInterval is how often ProduceQuotas rewrites its UsageFile at
+// most.
+const usageSaveInterval = time.Second
+
+// ProduceQuotas caps the bytes of record values each subject may produce
+// over its lifetime, resolved like RateLimits; zero is unlimited. It is
+// not a storage quota: the log keeps no record of who produced what, so
+// bytes truncated or offloaded from the log aren't given back. Usage only
+// outlives the server with UsageFile. Quotas are per subject: the log has
+// no topics to give quotas to.
+type ProduceQuotas struct {
+	Default  uint64
+	Subjects map[string]uint64
+	Roles    map[string]uint64
+	// UsageFile, when set, keeps usage across restarts. It's read on
+	// first use and rewritten at most every usageSaveInterval, and by
+	// Flush, so a crash forgets at most the usage since the last write.
+	UsageFile string
+
+	mu     sync.Mutex
+	usage  map[string]uint64
+	loaded bool
+	dirty  bool
+	saved  time.Time
+	// saveErr is the last failure to write UsageFile, retried at the
+	// next change and returned by Flush.
+	saveErr error
+}
+
+func moreQuota(a, b uint64) bool { return a == 0 || (b != 0 && a > b) }
+
+// reserve counts size bytes against the subject's quota, failing if that
+// would go over it.
+func (q *ProduceQuotas) reserve(id auth.Identity, roles func() []string, size uint64) error {
+	quota := resolve(id, q.Subjects, q.Roles, q.Default, roles, moreQuota)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.load(); err != nil {
+		return status.Errorf(codes.Internal, "failed to load quota usage: %v", err)
+	}
+	used := q.usage[id.Subject]
+	if quota != 0 && used+size > quota {
+		return ErrQuotaExceeded{Subject: id.Subject, Used: used, Quota: quota}
+	}
+	q.usage[id.Subject] = used + size
+	q.changed()
+	return nil
+}
+
+// release gives back bytes reserved for a record that was not stored.
+func (q *ProduceQuotas) release(subject string, size uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage[subject] -= size
+	q.changed()
+}
+
+// Usage returns the bytes subject has produced.
+func (q *ProduceQuotas) Usage(subject string) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.load()
+	return q.usage[subject]
+}
+
+// Flush writes usage not yet in UsageFile, for a clean shutdown.
+func (q *ProduceQuotas) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.load(); err != nil {
+		return err
+	}
+	if q.dirty {
+		q.save()
+	}
+	return q.saveErr
+}
+
+// load reads UsageFile the first time it's called. Callers hold q.mu.
+func (q *ProduceQuotas) load() error {
+	if q.loaded {
+		return nil
+	}
+	usage := make(map[string]uint64)
+	if q.UsageFile != "" {
+		b, err := os.ReadFile(q.UsageFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &usage); err != nil {
+				return fmt.Errorf("%s: %w", q.UsageFile, err)
+			}
+		}
+	}
+	q.usage = usage
+	q.loaded = true
+	return nil
+}
+
+// changed saves the usage if the last save is old enough. Callers hold
+// q.mu.
+func (q *ProduceQuotas) changed() {
+	q.dirty = true
+	if q.UsageFile != "" && time.Since(q.saved) >= usageSaveInterval {
+		q.save()
+	}
+}
+
+// save replaces UsageFile with the usage. Callers hold q.mu.
+func (q *ProduceQuotas) save() {
+	if q.UsageFile == "" {
+		q.dirty = false
+		return
+	}
+	b, err := json.Marshal(q.usage)
+	if err == nil {
+		tmp := q.UsageFile + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, q.UsageFile)
+		}
+	}
+	q.saved = time.Now()
+	if q.saveErr = err; err == nil {
+		q.dirty = false
+	}
+}
+
+type ErrQuotaExceeded struct {
+	Subject string
+	Used    uint64
+	Quota   uint64
+}
+
+func (e ErrQuotaExceeded) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("produce quota exceeded for %s: %d of %d bytes produced", e.Subject, e.Used, e.Quota),
+	)
+	std, err := st.WithDetails(&errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     e.Subject,
+			Description: fmt.Sprintf("%d of %d bytes produced", e.Used, e.Quota),
+		}},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	api "Proyecto/api/v1"
+	"Proyecto/auth"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Limit is a token bucket for one subject's produce traffic. A zero rate
+// is unlimited. Bursts default to one second's worth of traffic.
+type Limit struct {
+	RecordsPerSecond float64
+	BytesPerSecond   float64
+	RecordBurst      int
+	ByteBurst        int
+}
+
+// RateLimits throttles Produce and ProduceStream per authenticated
+// subject. A subject's own entry wins; otherwise the most generous entry
+// among its roles, then Default. A throttled record ends a ProduceStream,
+// unless it's pipelined, which reports it in the record's response.
+type RateLimits struct {
+	Default  Limit
+	Subjects map[string]Limit
+	Roles    map[string]Limit
+
+	mu      sync.Mutex
+	buckets map[string]*buckets
+}
+
+type buckets struct {
+	limit   Limit
+	records *rate.Limiter
+	bytes   *rate.Limiter
+}
+
+func newLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(perSecond)))
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+func (l Limit) generous(o Limit) bool {
+	more := func(a, b float64) bool { return a <= 0 || (b > 0 && a > b) }
+	if l.RecordsPerSecond != o.RecordsPerSecond {
+		return more(l.RecordsPerSecond, o.RecordsPerSecond)
+	}
+	return more(l.BytesPerSecond, o.BytesPerSecond)
+}
+
+// allow takes one record of size bytes from the subject's buckets.
+func (l *RateLimits) allow(id auth.Identity, roles func() []string, size int) error {
+	limit := resolve(id, l.Subjects, l.Roles, l.Default, roles, Limit.generous)
+	l.mu.Lock()
+	b, ok := l.buckets[id.Subject]
+	if !ok || b.limit != limit {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*buckets)
+		}
+		b = &buckets{
+			limit:   limit,
+			records: newLimiter(limit.RecordsPerSecond, limit.RecordBurst),
+			bytes:   newLimiter(limit.BytesPerSecond, limit.ByteBurst),
+		}
+		l.buckets[id.Subject] = b
+	}
+	l.mu.Unlock()
+
+	now := time.Now()
+	records := b.records.ReserveN(now, 1)
+	bytes := b.bytes.ReserveN(now, size)
+	if !bytes.OK() {
+		records.CancelAt(now)
+		return status.Errorf(
+			codes.ResourceExhausted,
+			"record of %d bytes exceeds %s's byte burst of %d",
+			size, id.Subject, b.bytes.Burst(),
+		)
+	}
+	delay := max(records.DelayFrom(now), bytes.DelayFrom(now))
+	if delay > 0 {
+		records.CancelAt(now)
+		bytes.CancelAt(now)
+		return ErrRateLimited{Subject: id.Subject, RetryAfter: delay}
+	}
+	return nil
+}
+
+// resolve picks the subject's own value, else the best among its roles
+// (its groups first, then roles from the ACL), else def.
+func resolve[T any](
+	id auth.Identity,
+	subjects, roles map[string]T,
+	def T,
+	aclRoles func() []string,
+	better func(a, b T) bool,
+) T {
+	if v, ok := subjects[id.Subject]; ok {
+		return v
+	}
+	if len(roles) == 0 {
+		return def
+	}
+	var best T
+	found := false
+	for _, role := range append(append([]string{}, id.Groups...), aclRoles()...) {
+		if v, ok := roles[role]; ok && (!found || better(v, best)) {
+			best, found = v, true
+		}
+	}
+	if !found {
+		return def
+	}
+	return best
+}
+
+type ErrRateLimited struct {
+	Subject    string
+	RetryAfter time.Duration
+}
+
+func (e ErrRateLimited) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("rate limit exceeded for %s, retry after %s", e.Subject, e.RetryAfter),
+	)
+	std, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(e.RetryAfter),
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrRateLimited) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// rateLimit takes the record of req from the caller's buckets.
+func (s *grpcServer) rateLimit(ctx context.Context, req *api.ProduceRequest) error {
+	id := identity(ctx)
+	return s.RateLimits.allow(id, s.rolesOf(id.Subject), len(req.GetRecord().GetValue()))
+}
+
+// rolesOf returns a lookup of the subject's roles in the ACL, if the
+// authorizer knows about roles.
+func (s *grpcServer) rolesOf(subject string) func() []string {
+	return func() []string {
+		if r, ok := s.Authorizer.(interface{ Roles(string) []string }); ok {
+			return r.Roles(subject)
+		}
+		return nil
+	}
+}
@@ -2,91 +2,286 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
 
 	api "Proyecto/api/v1"
+	"Proyecto/auth"
+	"Proyecto/tracing"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 )
 
 type Config struct {
 	CommitLog  CommitLog
 	Authorizer Authorizer
+	// MaxInFlight enables pipelined ProduceStream: up to MaxInFlight
+	// records are read ahead of their acknowledgements and per-record
+	// errors are returned in the response instead of closing the stream.
+	MaxInFlight int
+	// Metrics, when set, instruments the server and, if CommitLog
+	// implements LogStats, exports the log's layout.
+	Metrics *Metrics
+	// TracerProvider, when set, traces every RPC and every append/read.
+	TracerProvider trace.TracerProvider
+	// Logger, when set, logs every authenticated RPC with its subject,
+	// duration and status.
+	Logger *slog.Logger
+	// Health serves grpc.health.v1; NewGRPCServer creates one when unset
+	// and adds a readiness check for CommitLog if it has a Ready method.
+	Health *Health
+	// IdentitySource picks the certificate field used as the subject;
+	// the common name when empty.
+	IdentitySource IdentitySource
+	// Authenticators identify callers, tried in order until one finds
+	// credentials it handles. Defaults to TLSAuthenticator(IdentitySource).
+	// Give each listener its own Config to mix mTLS and JWT per listener.
+	Authenticators []Authenticator
+	// Revocation, when set, rejects callers whose verified client
+	// certificate chain it fails with Unauthenticated, on every RPC, so
+	// connections opened before a certificate was revoked are cut off
+	// too. config.NewRevocationChecker makes one from CRL files.
+	Revocation func(chains [][]*x509.Certificate) error
+	// PolicyAdmin, when set, serves the Admin service to subjects allowed
+	// the admin action.
+	PolicyAdmin PolicyAdmin
+	// RateLimits, when set, throttles each subject's produce traffic.
+	RateLimits *RateLimits
+	// ProduceQuotas, when set, caps the bytes each subject may produce.
+	ProduceQuotas *ProduceQuotas
+	// MaxRecordBytes rejects records whose encoded size is larger.
+	MaxRecordBytes int
+	// MaxMessageBytes sets the largest message the server will receive,
+	// 4MiB when unset as in gRPC.
+	MaxMessageBytes int
 }
 
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	adminAction    = "admin"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
 
+// streamPollInterval is how often a ConsumeStream past the end of the log
+// looks for records appended other than through this server.
+const streamPollInterval = 100 * time.Millisecond
+
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	tracer trace.Tracer
+
+	// appended is closed, and replaced, after each append, to wake the
+	// streams waiting past the end of the log.
+	mu       sync.Mutex
+	appended chan struct{}
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	tp := config.TracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
 	srv = &grpcServer{
-		Config: config,
+		Config:   config,
+		tracer:   tp.Tracer(tracing.InstrumentationName),
+		appended: make(chan struct{}),
 	}
 	return srv, nil
 }
 
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
-	opts = append(opts, grpc.StreamInterceptor(
-		grpc_middleware.ChainStreamServer(
-			grpc_auth.StreamServerInterceptor(authenticate),
-		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-		grpc_auth.UnaryServerInterceptor(authenticate),
-	)))
-	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
 	}
+	var streamInterceptors []grpc.StreamServerInterceptor
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	if config.Metrics != nil {
+		streamInterceptors = append(streamInterceptors, config.Metrics.streamInterceptor)
+		unaryInterceptors = append(unaryInterceptors, config.Metrics.unaryInterceptor)
+		if stats, ok := config.CommitLog.(LogStats); ok {
+			if err := config.Metrics.RegisterLog(stats); err != nil {
+				return nil, err
+			}
+		}
+	}
+	authenticators := config.Authenticators
+	if len(authenticators) == 0 {
+		authenticators = []Authenticator{TLSAuthenticator(config.IdentitySource)}
+	}
+	identify := anyOf(authenticators...)
+	if config.Revocation != nil {
+		identify = rejectRevoked(identify, config.Revocation)
+	}
+	authenticate := authenticator(identify)
+	streamInterceptors = append(streamInterceptors,
+		grpc_auth.StreamServerInterceptor(authenticate),
+	)
+	unaryInterceptors = append(unaryInterceptors,
+		grpc_auth.UnaryServerInterceptor(authenticate),
+	)
+	if config.Logger != nil {
+		streamInterceptors = append(streamInterceptors, streamLogger(config.Logger))
+		unaryInterceptors = append(unaryInterceptors, unaryLogger(config.Logger))
+	}
+	if config.TracerProvider != nil {
+		opts = append(opts, grpc.StatsHandler(otelgrpc.NewServerHandler(
+			otelgrpc.WithTracerProvider(config.TracerProvider),
+			otelgrpc.WithPropagators(tracing.Propagator),
+		)))
+	}
+	if config.MaxMessageBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(config.MaxMessageBytes))
+	}
+	opts = append(opts, grpc.StreamInterceptor(
+		grpc_middleware.ChainStreamServer(streamInterceptors...),
+	), grpc.UnaryInterceptor(
+		grpc_middleware.ChainUnaryServer(unaryInterceptors...),
+	))
+	gsrv := grpc.NewServer(opts...)
 	api.RegisterLogServer(gsrv, srv)
+	if config.PolicyAdmin != nil {
+		api.RegisterAdminServer(gsrv, &adminServer{srv: srv})
+	}
+	if config.Health == nil {
+		config.Health = NewHealth()
+	}
+	if l, ok := config.CommitLog.(interface{ Ready() error }); ok {
+		config.Health.AddCheck("log", l.Ready)
+	}
+	healthpb.RegisterHealthServer(gsrv, config.Health)
 	return gsrv, nil
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	ctx, span := s.tracer.Start(ctx, "Log.Append", trace.WithAttributes(
+		attribute.String("log.subject", subject(ctx)),
+		attribute.Int("log.record_size", len(req.GetRecord().GetValue())),
+	))
+	defer span.End()
+	if err := s.authorize(ctx, produceAction); err != nil {
 		return nil, err
 	}
+	if err := s.validate(req); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	// Rate limits and quotas are checked here rather than in an
+	// interceptor: ProduceStream calls Produce for each record, while an
+	// interceptor only sees the stream, and an error from it would end
+	// the stream instead of being reported for the record.
+	if s.RateLimits != nil {
+		if err := s.rateLimit(ctx, req); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+	size := uint64(len(req.GetRecord().GetValue()))
+	if s.ProduceQuotas != nil {
+		id := identity(ctx)
+		if err := s.ProduceQuotas.reserve(id, s.rolesOf(id.Subject), size); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+	start := time.Now()
 	offset, err := s.CommitLog.Append(req.Record)
+	if s.Metrics != nil {
+		s.Metrics.appendDuration.Observe(time.Since(start).Seconds())
+	}
 	if err != nil {
+		if s.ProduceQuotas != nil {
+			s.ProduceQuotas.release(subject(ctx), size)
+		}
+		span.RecordError(err)
 		return nil, err
 	}
+	s.notifyAppended()
+	span.SetAttributes(attribute.Int64("log.offset", int64(offset)))
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+func (s *grpcServer) notifyAppended() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.appended)
+	s.appended = make(chan struct{})
+}
+
+// waitAppended returns a channel closed after the next append.
+func (s *grpcServer) waitAppended() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appended
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		consumeAction,
-	); err != nil {
+	ctx, span := s.tracer.Start(ctx, "Log.Read", trace.WithAttributes(
+		attribute.String("log.subject", subject(ctx)),
+		attribute.Int64("log.offset", int64(req.Offset)),
+	))
+	defer span.End()
+	res, err := s.consume(ctx, req)
+	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	span.SetAttributes(attribute.Int("log.record_size", len(res.Record.Value)))
+	return res, nil
+}
+
+func (s *grpcServer) consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	record, err := s.read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+func (s *grpcServer) read(off uint64) (*api.Record, error) {
+	start := time.Now()
+	record, err := s.CommitLog.Read(off)
+	if s.Metrics != nil {
+		s.Metrics.readDuration.Observe(time.Since(start).Seconds())
+	}
+	return record, err
+}
+
+func (s *grpcServer) authorize(ctx context.Context, action string) error {
+	var err error
+	if a, ok := s.Authorizer.(IdentityAuthorizer); ok {
+		err = a.AuthorizeIdentity(identity(ctx), objectWildcard, action)
+	} else {
+		err = s.Authorizer.Authorize(subject(ctx), objectWildcard, action)
+	}
+	if err != nil && s.Metrics != nil {
+		s.Metrics.authDenials.WithLabelValues(action).Inc()
+	}
+	return err
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	if s.MaxInFlight > 0 {
+		return s.producePipelined(stream)
+	}
 	for {
 		req, err := stream.Recv()
 		if err != nil {
@@ -96,31 +291,108 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 		if err != nil {
 			return err
 		}
+		res.CorrelationId = req.CorrelationId
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// producePipelined receives requests in its own goroutine so the client can
+// keep up to MaxInFlight records unacknowledged, while records are appended
+// and acknowledged in the order they arrived.
+func (s *grpcServer) producePipelined(stream api.Log_ProduceStreamServer) error {
+	ctx := stream.Context()
+	reqs := make(chan *api.ProduceRequest, s.MaxInFlight)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(reqs)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				recvErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+	for req := range reqs {
+		res, err := s.Produce(ctx, req)
+		if err != nil {
+			st := status.Convert(err)
+			res = &api.ProduceResponse{Error: &api.ProduceError{
+				Code:    uint32(st.Code()),
+				Message: st.Message(),
+			}}
+		}
+		res.CorrelationId = req.CorrelationId
 		if err = stream.Send(res); err != nil {
 			return err
 		}
 	}
+	if err := <-recvErr; err != io.EOF {
+		return err
+	}
+	return nil
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if s.Metrics != nil {
+		s.Metrics.subscribers.Inc()
+		defer s.Metrics.subscribers.Dec()
+	}
+	ctx := stream.Context()
+	// Access is checked when the stream opens and again before each
+	// record after the first, so revoking it ends the stream, but not
+	// while waiting past the end of the log, which would flood an
+	// auditing authorizer.
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return err
+	}
+	checked := true
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
+		// Taken before the read, so an append right after it still
+		// wakes the wait.
+		appended := s.waitAppended()
+		record, err := s.read(req.Offset)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-appended:
+			case <-poll.C:
 			}
-			if err = stream.Send(res); err != nil {
+			continue
+		default:
+			return err
+		}
+		if !checked {
+			if err := s.authorize(ctx, consumeAction); err != nil {
 				return err
 			}
-			req.Offset++
 		}
+		checked = false
+		// Waits past the end of the log are not traced, only the
+		// records actually read.
+		_, span := s.tracer.Start(ctx, "Log.Read", trace.WithAttributes(
+			attribute.String("log.subject", subject(ctx)),
+			attribute.Int64("log.offset", int64(req.Offset)),
+			attribute.Int("log.record_size", len(record.Value)),
+		))
+		span.End()
+		if err = stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+		req.Offset++
 	}
 }
 
@@ -133,29 +405,8 @@ type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
-func authenticate(ctx context.Context) (context.Context, error) {
-	peer, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(
-			codes.Unknown,
-			"Can't find peer information",
-		).Err()
-	}
-	if peer.AuthInfo == nil {
-		return ctx, status.New(
-			codes.Unauthenticated,
-			"No security on transport protocol",
-		).Err()
-	}
-
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
-	return ctx, nil
-}
-
-func subject(ctx context.Context) string {
-	return ctx.Value(subjectContextKey{}).(string)
+// IdentityAuthorizer is implemented by authorizers that also take the
+// client's groups into account.
+type IdentityAuthorizer interface {
+	AuthorizeIdentity(id auth.Identity, object, action string) error
 }
-
-type subjectContextKey struct{}
@@ -1,20 +1,47 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
 	"net"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	tlsconfig "Proyecto/CA"
 	api "Proyecto/api/v1"
 	"Proyecto/auth"
+	"Proyecto/certgen"
+	"Proyecto/client"
 	log "Proyecto/log"
 
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -38,10 +65,36 @@ func TestServer(t *testing.T) {
 	}
 }
 
+var pkiDir string
+
+// TestMain issues a throwaway PKI from the CSRs in CA/ so the tests don't
+// depend on certificates in the home directory.
+func TestMain(m *testing.M) {
+	var err error
+	pkiDir, err = os.MkdirTemp("", "server-test-pki")
+	if err != nil {
+		panic(err)
+	}
+	opts, err := certgen.LoadOptions("../CA", "root", "nobody")
+	if err == nil {
+		err = certgen.Generate(pkiDir, opts)
+	}
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(pkiDir)
+	os.Exit(code)
+}
+
+func pkiFile(name string) string {
+	return filepath.Join(pkiDir, name)
+}
+
 // END: intro
 
 // START: setup
-func setupTest(t *testing.T, fn func(*Config)) (
+func setupTest(t testing.TB, fn func(*Config), dialOpts ...grpc.DialOption) (
 	rootClient api.LogClient,
 	nobodyClient api.LogClient,
 	config *Config,
@@ -60,12 +113,14 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		tlsConfig, err := tlsconfig.SetupTLSConfig(tlsconfig.TLSConfig{
 			CertFile: crtPath,
 			KeyFile:  keyPath,
-			CAFile:   tlsconfig.CAFile,
+			CAFile:   pkiFile("ca.pem"),
 			Server:   false,
 		})
 		require.NoError(t, err)
 		tlscreds := credentials.NewTLS(tlsConfig)
-		opts := []grpc.DialOption{grpc.WithTransportCredentials(tlscreds)}
+		opts := append([]grpc.DialOption{
+			grpc.WithTransportCredentials(tlscreds),
+		}, dialOpts...)
 		conn, err := grpc.NewClient(l.Addr().String(), opts...)
 		require.NoError(t, err)
 		client := api.NewLogClient(conn)
@@ -74,20 +129,20 @@ func setupTest(t *testing.T, fn func(*Config)) (
 
 	var rootConn *grpc.ClientConn
 	rootConn, rootClient, _ = newClient(
-		tlsconfig.RootClientCertFile,
-		tlsconfig.RootClientKeyFile,
+		pkiFile("root-client.pem"),
+		pkiFile("root-client-key.pem"),
 	)
 
 	var nobodyConn *grpc.ClientConn
 	nobodyConn, nobodyClient, _ = newClient(
-		tlsconfig.NobodyClientCertFile,
-		tlsconfig.NobodyClientKeyFile,
+		pkiFile("nobody-client.pem"),
+		pkiFile("nobody-client-key.pem"),
 	)
 
 	severTLSConfig, err := tlsconfig.SetupTLSConfig(tlsconfig.TLSConfig{
-		CertFile: tlsconfig.ServerCertFile,
-		KeyFile:  tlsconfig.ServerKeyFile,
-		CAFile:   tlsconfig.CAFile,
+		CertFile: pkiFile("server.pem"),
+		KeyFile:  pkiFile("server-key.pem"),
+		CAFile:   pkiFile("ca.pem"),
 		Server:   true,
 	})
 
@@ -100,7 +155,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
-	authorizer := auth.New(tlsconfig.ACLModelFile, tlsconfig.ACLPolicyFile)
+	authorizer := auth.New("", "")
 
 	config = &Config{
 		CommitLog:  clog,
@@ -262,3 +317,954 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+// START: pipelined
+type rejectingLog struct {
+	CommitLog
+	reject []byte
+}
+
+func (l rejectingLog) Append(record *api.Record) (uint64, error) {
+	if bytes.Equal(record.Value, l.reject) {
+		return 0, status.Error(codes.FailedPrecondition, "record rejected")
+	}
+	return l.CommitLog.Append(record)
+}
+
+func TestPipelinedProduceStream(t *testing.T) {
+	rootClient, _, _, teardown := setupTest(t, func(config *Config) {
+		config.MaxInFlight = 4
+		config.CommitLog = rejectingLog{
+			CommitLog: config.CommitLog,
+			reject:    []byte("bad"),
+		}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	producer, err := client.NewProducer(ctx, rootClient, 4)
+	require.NoError(t, err)
+
+	values := []string{"a", "bad", "b", "c", "bad", "d"}
+	go func() {
+		for i, v := range values {
+			if err := producer.Send(uint64(i), &api.Record{
+				Value: []byte(v),
+			}); err != nil {
+				return
+			}
+		}
+		producer.CloseSend()
+	}()
+
+	var offsets []uint64
+	for range values {
+		res, err := producer.Recv()
+		require.NoError(t, err)
+		if values[res.CorrelationId] == "bad" {
+			require.NotNil(t, res.Error)
+			require.Equal(t, uint32(codes.FailedPrecondition), res.Error.Code)
+			continue
+		}
+		require.Nil(t, res.Error)
+		offsets = append(offsets, res.Offset)
+	}
+	require.Equal(t, []uint64{0, 1, 2, 3}, offsets)
+
+	consume, err := rootClient.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.NoError(t, err)
+	require.Equal(t, []byte("d"), consume.Record.Value)
+}
+
+// blockingLog holds appends until unblock is closed.
+type blockingLog struct {
+	CommitLog
+	unblock chan struct{}
+}
+
+func (l blockingLog) Append(record *api.Record) (uint64, error) {
+	<-l.unblock
+	return l.CommitLog.Append(record)
+}
+
+func TestProducerStreamFailure(t *testing.T) {
+	unblock := make(chan struct{})
+	rootClient, _, _, teardown := setupTest(t, func(config *Config) {
+		config.CommitLog = blockingLog{CommitLog: config.CommitLog, unblock: unblock}
+	})
+	defer teardown()
+	defer close(unblock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	producer, err := client.NewProducer(ctx, rootClient, 1)
+	require.NoError(t, err)
+	require.NoError(t, producer.Send(0, &api.Record{Value: []byte("a")}))
+
+	// The second Send waits for the first record's slot, which is never
+	// acknowledged, and fails with the stream instead.
+	sent := make(chan error)
+	go func() {
+		sent <- producer.Send(1, &api.Record{Value: []byte("b")})
+	}()
+	cancel()
+	_, err = producer.Recv()
+	require.Equal(t, codes.Canceled, status.Code(err))
+	select {
+	case err := <-sent:
+		require.Equal(t, codes.Canceled, status.Code(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send still blocked")
+	}
+	require.Equal(t, codes.Canceled, status.Code(producer.Send(2, &api.Record{Value: []byte("c")})))
+}
+
+func BenchmarkProduceStream(b *testing.B) {
+	for _, inFlight := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("inflight=%d", inFlight), func(b *testing.B) {
+			rootClient, _, _, teardown := setupTest(b, func(config *Config) {
+				config.MaxInFlight = inFlight
+			})
+			defer teardown()
+
+			producer, err := client.NewProducer(
+				context.Background(), rootClient, inFlight,
+			)
+			require.NoError(b, err)
+			record := &api.Record{Value: []byte("hello world")}
+
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if err := producer.Send(uint64(i), record); err != nil {
+						return
+					}
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				res, err := producer.Recv()
+				require.NoError(b, err)
+				require.Nil(b, res.Error)
+			}
+		})
+	}
+}
+
+// END: pipelined
+
+// START: metrics
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	rootClient, nobodyClient, _, teardown := setupTest(t, func(config *Config) {
+		config.Metrics = metrics
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce, err := rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = rootClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	for _, want := range []string{
+		`grpc_server_handled_total{code="OK",method="/log.v1.Log/Produce"} 1`,
+		`grpc_server_handled_total{code="PermissionDenied",method="/log.v1.Log/Produce"} 1`,
+		`grpc_server_handling_seconds_count{method="/log.v1.Log/Consume"} 1`,
+		`auth_denials_total{action="produce"} 1`,
+		`log_append_seconds_count 1`,
+		`log_read_seconds_count 1`,
+		`log_consume_stream_subscribers 0`,
+		`log_segments 1`,
+		`log_lowest_offset 0`,
+		`log_highest_offset 0`,
+	} {
+		require.Contains(t, string(body), want)
+	}
+}
+
+// END: metrics
+
+// START: tracing
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	rootClient, _, _, teardown := setupTest(t, func(config *Config) {
+		config.TracerProvider = tp
+	}, client.WithTracing(tp))
+	defer teardown()
+
+	ctx := context.Background()
+	tracer := client.NewTracer(tp)
+	record := &api.Record{Value: []byte("hello world")}
+	produce, err := tracer.Produce(ctx, rootClient, record)
+	require.NoError(t, err)
+
+	consume, err := rootClient.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	_, span := tracer.StartProcess(ctx, consume.Record)
+	span.End()
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	producer := spans["produce"]
+	appended := spans["Log.Append"]
+	read := spans["Log.Read"]
+	process := spans["process"]
+
+	require.True(t, producer.SpanContext.IsValid())
+	require.Equal(t, producer.SpanContext.TraceID(), appended.SpanContext.TraceID())
+	require.Contains(t, appended.Attributes, attribute.String("log.subject", "root"))
+	require.Contains(t, appended.Attributes, attribute.Int64("log.offset", 0))
+	require.Contains(t, appended.Attributes, attribute.Int("log.record_size", 11))
+	require.Contains(t, read.Attributes, attribute.Int64("log.offset", 0))
+
+	require.Len(t, process.Links, 1)
+	require.Equal(t, producer.SpanContext.SpanID(), process.Links[0].SpanContext.SpanID())
+	require.NotEqual(t, producer.SpanContext.TraceID(), process.SpanContext.TraceID())
+}
+
+// END: tracing
+
+// START: logging
+func TestLoggingAndAudit(t *testing.T) {
+	var buf bytes.Buffer
+	auditDir, err := os.MkdirTemp("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(auditDir)
+	auditLog, err := log.NewLog(auditDir, log.Config{})
+	require.NoError(t, err)
+	var auditor *auth.Auditor
+	var identified atomic.Int32
+
+	rootClient, nobodyClient, _, teardown := setupTest(t, func(config *Config) {
+		config.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+		tlsAuth := TLSAuthenticator(IdentityCommonName)
+		config.Authenticators = []Authenticator{func(ctx context.Context) (auth.Identity, error) {
+			identified.Add(1)
+			return tlsAuth(ctx)
+		}}
+		auditor, err = auth.NewAuditor(config.Authorizer, auditLog, "")
+		require.NoError(t, err)
+		config.Authorizer = auditor
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err = rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line map[string]interface{}
+		require.NoError(t, dec.Decode(&line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 2)
+	require.Equal(t, "/log.v1.Log/Produce", lines[0]["method"])
+	require.Equal(t, "root", lines[0]["subject"])
+	require.Equal(t, "OK", lines[0]["status"])
+	require.Equal(t, float64(0), lines[0]["offset"])
+	require.Contains(t, lines[0], "duration")
+	require.Equal(t, "nobody", lines[1]["subject"])
+	require.Equal(t, "PermissionDenied", lines[1]["status"])
+	// Logging reuses the identity authenticate found.
+	require.Equal(t, int32(2), identified.Load())
+
+	var entries []auth.AuditEntry
+	require.NoError(t, auditor.Replay(func(_ uint64, e auth.AuditEntry) error {
+		entries = append(entries, e)
+		return nil
+	}))
+	require.Len(t, entries, 2)
+	require.Equal(t, "root", entries[0].Subject)
+	require.Equal(t, "produce", entries[0].Action)
+	require.True(t, entries[0].Allowed)
+	require.Equal(t, "nobody", entries[1].Subject)
+	require.Equal(t, "consume", entries[1].Action)
+	require.False(t, entries[1].Allowed)
+	require.Equal(t, entries[0].Hash, entries[1].Prev)
+}
+
+// END: logging
+
+func TestConsumeStreamWaitsPastEnd(t *testing.T) {
+	auditDir := t.TempDir()
+	auditLog, err := log.NewLog(auditDir, log.Config{})
+	require.NoError(t, err)
+	var auditor *auth.Auditor
+	rootClient, _, _, teardown := setupTest(t, func(config *Config) {
+		auditor, err = auth.NewAuditor(config.Authorizer, auditLog, "")
+		require.NoError(t, err)
+		config.Authorizer = auditor
+	})
+	defer teardown()
+	audited := func() (actions []string) {
+		require.NoError(t, auditor.Replay(func(_ uint64, e auth.AuditEntry) error {
+			actions = append(actions, e.Action)
+			return nil
+		}))
+		return actions
+	}
+
+	ctx := context.Background()
+	stream, err := rootClient.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	// An idle subscriber is authorized once, not on every poll.
+	time.Sleep(3 * streamPollInterval)
+	require.Equal(t, []string{"consume"}, audited())
+
+	for i := 0; i < 2; i++ {
+		value := []byte(fmt.Sprint("record ", i))
+		_, err = rootClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, value, res.Record.Value)
+	}
+	require.Equal(t, []string{"consume", "produce", "produce", "consume"}, audited())
+}
+
+// START: health
+func TestHealth(t *testing.T) {
+	_, _, config, teardown := setupTest(t, nil)
+	defer teardown()
+
+	ctx := context.Background()
+	clog := config.CommitLog.(*log.Log)
+	httpSrv := NewHTTPServer("", clog, nil, config.Health)
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		httpSrv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	check := func() healthpb.HealthCheckResponse_ServingStatus {
+		res, err := config.Health.Check(ctx, &healthpb.HealthCheckRequest{
+			Service: api.Log_ServiceDesc.ServiceName,
+		})
+		require.NoError(t, err)
+		return res.Status
+	}
+
+	require.Equal(t, 200, probe("/healthz"))
+	require.Equal(t, 200, probe("/readyz"))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check())
+
+	joined := false
+	config.Health.AddCheck("cluster", func() error {
+		if !joined {
+			return fmt.Errorf("not joined")
+		}
+		return nil
+	})
+	require.Equal(t, 503, probe("/readyz"))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check())
+	joined = true
+	require.Equal(t, 200, probe("/readyz"))
+
+	require.NoError(t, os.Chmod(clog.Dir, 0500))
+	if os.Geteuid() != 0 {
+		require.Equal(t, 503, probe("/readyz"))
+	}
+	require.NoError(t, os.Chmod(clog.Dir, 0700))
+	require.Equal(t, 200, probe("/readyz"))
+
+	require.NoError(t, clog.Close())
+	require.Equal(t, 503, probe("/readyz"))
+
+	config.Health.Shutdown()
+	require.Equal(t, 200, probe("/healthz"))
+	require.Equal(t, 503, probe("/readyz"))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check())
+}
+
+// END: health
+
+func TestHealthWatch(t *testing.T) {
+	health := NewHealth()
+	health.refreshInterval = 10 * time.Millisecond
+	var ready atomic.Bool
+	health.AddCheck("cluster", func() error {
+		if !ready.Load() {
+			return fmt.Errorf("not joined")
+		}
+		return nil
+	})
+	gsrv := grpc.NewServer()
+	healthpb.RegisterHealthServer(gsrv, health)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	watch, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	res, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+
+	// Nothing probes, yet the watcher sees the check pass and the
+	// shutdown.
+	ready.Store(true)
+	res, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+	health.Shutdown()
+	res, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+}
+
+// START: revocation
+func TestRevokedClient(t *testing.T) {
+	ca, err := certgen.Load(pkiFile("ca.pem"), pkiFile("ca-key.pem"))
+	require.NoError(t, err)
+	nobody, err := certgen.Load(pkiFile("nobody-client.pem"), pkiFile("nobody-client-key.pem"))
+	require.NoError(t, err)
+	crlFile := filepath.Join(t.TempDir(), "ca.crl")
+	crlNumber := int64(0)
+	writeCRL := func(revoked ...*x509.Certificate) {
+		crlNumber++
+		tmpl := &x509.RevocationList{
+			Number:     big.NewInt(crlNumber),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: time.Now().Add(time.Hour),
+		}
+		for _, c := range revoked {
+			tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+				x509.RevocationListEntry{SerialNumber: c.SerialNumber, RevocationTime: time.Now()})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.Cert, ca.Key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644))
+	}
+	writeCRL()
+	check, err := tlsconfig.NewRevocationChecker(crlFile)
+	require.NoError(t, err)
+
+	rootClient, nobodyClient, _, teardown := setupTest(t, func(config *Config) {
+		config.Revocation = check
+	})
+	defer teardown()
+	ctx := context.Background()
+	requireCodes := func(client api.LogClient, want codes.Code) {
+		t.Helper()
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		require.Equal(t, want, status.Code(err))
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+		require.Equal(t, want, status.Code(err))
+	}
+	// A new CRL is noticed within a second.
+	awaitCode := func(want codes.Code) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			_, err := nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+			return status.Code(err) == want
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+	requireCodes(nobodyClient, codes.PermissionDenied)
+
+	// The connections are already open, so only authenticate can
+	// notice the new CRL.
+	writeCRL(nobody.Cert)
+	awaitCode(codes.Unauthenticated)
+	requireCodes(nobodyClient, codes.Unauthenticated)
+	requireCodes(rootClient, codes.OK)
+
+	writeCRL()
+	awaitCode(codes.PermissionDenied)
+	requireCodes(nobodyClient, codes.PermissionDenied)
+}
+
+// END: revocation
+
+// START: identity
+func TestIdentity(t *testing.T) {
+	opts, err := certgen.LoadOptions("../CA")
+	require.NoError(t, err)
+	ca, err := certgen.Load(pkiFile("ca.pem"), pkiFile("ca-key.pem"))
+	require.NoError(t, err)
+	profile, err := opts.Config.Profile("client")
+	require.NoError(t, err)
+	csr := *opts.Client
+	csr.CN = "alice"
+	csr.Names = append([]certgen.Name(nil), csr.Names...)
+	csr.Names[0].OU = "producers"
+	csr.Hosts = []string{
+		"alice.example.org",
+		"alice@example.org",
+		"spiffe://example.org/ns/prod/sa/producer",
+	}
+	alice, err := ca.Issue(&csr, profile)
+	require.NoError(t, err)
+	csr.Hosts = nil
+	bare, err := ca.Issue(&csr, profile)
+	require.NoError(t, err)
+
+	withPeer := func(info credentials.AuthInfo) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: info})
+	}
+	verified := func(c *certgen.Cert) context.Context {
+		return withPeer(credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{c.Cert, ca.Cert}},
+		}})
+	}
+
+	for source, want := range map[IdentitySource]string{
+		IdentityCommonName: "alice",
+		IdentityDNSSAN:     "alice.example.org",
+		IdentityEmailSAN:   "alice@example.org",
+		IdentitySPIFFE:     "spiffe://example.org/ns/prod/sa/producer",
+	} {
+		id, err := TLSAuthenticator(source)(verified(alice))
+		require.NoError(t, err)
+		require.Equal(t, want, id.Subject)
+		require.Equal(t, []string{"producers"}, id.Groups)
+
+		_, err = TLSAuthenticator(source)(verified(bare))
+		if source != IdentityCommonName {
+			require.Equal(t, codes.Unauthenticated, status.Code(err))
+		}
+	}
+
+	identify := TLSAuthenticator(IdentityCommonName)
+	for name, ctx := range map[string]context.Context{
+		"no auth info":      withPeer(nil),
+		"not tls":           withPeer(plaintext{}),
+		"no verified chain": withPeer(credentials.TLSInfo{}),
+	} {
+		_, err := identify(ctx)
+		require.Equal(t, codes.Unauthenticated, status.Code(err), name)
+	}
+	_, err = identify(context.Background())
+	require.Equal(t, codes.Unknown, status.Code(err))
+
+	_, err = ParseIdentitySource("serial")
+	require.Error(t, err)
+}
+
+// END: identity
+
+type plaintext struct{}
+
+func (plaintext) AuthType() string { return "insecure" }
+
+// serve starts a server for config, with a fresh log unless config has
+// one, and returns its address. optionalCert lets clients connect without
+// a certificate.
+func serve(t *testing.T, config *Config, optionalCert bool) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serverTLS, err := tlsconfig.SetupTLSConfig(tlsconfig.TLSConfig{
+		CertFile:           pkiFile("server.pem"),
+		KeyFile:            pkiFile("server-key.pem"),
+		CAFile:             pkiFile("ca.pem"),
+		Server:             true,
+		OptionalClientCert: optionalCert,
+	})
+	require.NoError(t, err)
+	if config.CommitLog == nil {
+		clog, err := log.NewLog(t.TempDir(), log.Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { clog.Close() })
+		config.CommitLog = clog
+	}
+	server, err := NewGRPCServer(config, grpc.Creds(credentials.NewTLS(serverTLS)))
+	require.NoError(t, err)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return l.Addr().String()
+}
+
+// dial connects to addr presenting the named client certificate, e.g.
+// "root-client", or none when cert is empty.
+func dial(t *testing.T, addr, cert string, opts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+	cfg := tlsconfig.TLSConfig{CAFile: pkiFile("ca.pem")}
+	if cert != "" {
+		cfg.CertFile = pkiFile(cert + ".pem")
+		cfg.KeyFile = pkiFile(cert + "-key.pem")
+	}
+	clientTLS, err := tlsconfig.SetupTLSConfig(cfg)
+	require.NoError(t, err)
+	opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	conn, err := grpc.NewClient(addr, opts...)
+	require.NoError(t, err)
+	return conn
+}
+
+// START: jwt
+func TestJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"},
+	}})
+	require.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwks, 0644))
+
+	sign := func(signer *ecdsa.PrivateKey, claims jwt.Claims) string {
+		s, err := jose.NewSigner(jose.SigningKey{
+			Algorithm: jose.ES256,
+			Key:       jose.JSONWebKey{Key: signer, KeyID: "k1"},
+		}, (&jose.SignerOptions{}).WithType("JWT"))
+		require.NoError(t, err)
+		tok, err := jwt.Signed(s).Claims(claims).Serialize()
+		require.NoError(t, err)
+		return tok
+	}
+	now := time.Now()
+	claims := func(sub, aud string, exp time.Time) jwt.Claims {
+		return jwt.Claims{
+			Issuer:   "https://issuer.example.org",
+			Audience: jwt.Audience{aud},
+			Subject:  sub,
+			Expiry:   jwt.NewNumericDate(exp),
+			IssuedAt: jwt.NewNumericDate(now.Add(-time.Minute)),
+		}
+	}
+
+	jwtAuth, err := JWTAuthenticator(JWTConfig{
+		JWKSFile:  jwksFile,
+		Issuer:    "https://issuer.example.org",
+		Audience:  "proglog",
+		ClockSkew: 30 * time.Second,
+	})
+	require.NoError(t, err)
+	// Leaving either out would stop it being checked.
+	for _, c := range []JWTConfig{
+		{JWKSFile: jwksFile, Audience: "proglog"},
+		{JWKSFile: jwksFile, Issuer: "https://issuer.example.org"},
+	} {
+		_, err := JWTAuthenticator(c)
+		require.Error(t, err)
+	}
+
+	addr := serve(t, &Config{
+		Authorizer:     auth.New("", ""),
+		Authenticators: []Authenticator{TLSAuthenticator(IdentityCommonName), jwtAuth},
+	}, true)
+
+	produce := func(cert string, opts ...grpc.DialOption) error {
+		conn := dial(t, addr, cert, opts...)
+		defer conn.Close()
+		_, err := api.NewLogClient(conn).Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello")},
+		})
+		return err
+	}
+	withToken := func(tok string) grpc.DialOption {
+		return client.WithBearerToken(tok)
+	}
+
+	require.NoError(t, produce("", withToken(sign(key, claims("root", "proglog", now.Add(time.Minute))))))
+	// Within the allowed clock skew.
+	require.NoError(t, produce("", withToken(sign(key, claims("root", "proglog", now.Add(-10*time.Second))))))
+	// Certificates still work on the same listener.
+	require.NoError(t, produce("root-client"))
+
+	err = produce("", withToken(sign(key, claims("nobody", "proglog", now.Add(time.Minute)))))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	for name, tok := range map[string]string{
+		"expired":        sign(key, claims("root", "proglog", now.Add(-time.Minute))),
+		"wrong audience": sign(key, claims("root", "other", now.Add(time.Minute))),
+		"unknown key":    sign(other, claims("root", "proglog", now.Add(time.Minute))),
+		"no expiry":      sign(key, jwt.Claims{Issuer: "https://issuer.example.org", Audience: jwt.Audience{"proglog"}, Subject: "root"}),
+		"garbage":        "not-a-token",
+	} {
+		err := produce("", withToken(tok))
+		require.Equal(t, codes.Unauthenticated, status.Code(err), name)
+	}
+	err = produce("")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// END: jwt
+
+// START: admin
+func TestAdmin(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(policy, []byte(
+		"p, admins, *, admin, allow\n"+
+			"g, root, admins\n",
+	), 0644))
+	authorizer := auth.New("", policy)
+	addr := serve(t, &Config{Authorizer: authorizer, PolicyAdmin: authorizer}, false)
+
+	ctx := context.Background()
+	rootConn := dial(t, addr, "root-client")
+	defer rootConn.Close()
+	nobodyConn := dial(t, addr, "nobody-client")
+	defer nobodyConn.Close()
+	admin := api.NewAdminClient(rootConn)
+	nobodyAdmin := api.NewAdminClient(nobodyConn)
+	nobodyLog := api.NewLogClient(nobodyConn)
+	produce := func() error {
+		_, err := nobodyLog.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello")},
+		})
+		return err
+	}
+
+	_, err := nobodyAdmin.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyAdmin.AddRoleForUser(ctx, &api.AddRoleForUserRequest{User: "nobody", Role: "admins"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, codes.PermissionDenied, status.Code(produce()))
+
+	added, err := admin.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{
+		Subject: "producers", Object: "*", Action: "produce",
+	}})
+	require.NoError(t, err)
+	require.True(t, added.Added)
+	role, err := admin.AddRoleForUser(ctx, &api.AddRoleForUserRequest{User: "nobody", Role: "producers"})
+	require.NoError(t, err)
+	require.True(t, role.Added)
+	require.NoError(t, produce())
+
+	list, err := admin.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Policies, 2)
+	require.Equal(t, "allow", list.Policies[1].Effect)
+	require.Len(t, list.Roles, 2)
+
+	_, err = admin.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{
+		Subject: "producers", Object: "*", Action: "produce", Effect: "maybe",
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	removed, err := admin.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: &api.Policy{
+		Subject: "producers", Object: "*", Action: "produce",
+	}})
+	require.NoError(t, err)
+	require.True(t, removed.Removed)
+	require.Equal(t, codes.PermissionDenied, status.Code(produce()))
+
+	// Changes were saved to the policy file.
+	reopened := auth.New("", policy)
+	require.NoError(t, reopened.Authorize("root", "*", "admin"))
+	require.Error(t, reopened.Authorize("nobody", "*", "produce"))
+	_, roles := reopened.Policies()
+	require.Contains(t, roles, auth.RoleAssignment{User: "nobody", Role: "producers"})
+}
+
+// END: admin
+
+// START: ratelimit
+func TestRateLimits(t *testing.T) {
+	ctx := context.Background()
+	produce := func(c api.LogClient, value string) error {
+		_, err := c.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		return err
+	}
+	retryAfter := func(err error) time.Duration {
+		t.Helper()
+		st := status.Convert(err)
+		require.Equal(t, codes.ResourceExhausted, st.Code(), err)
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.RetryInfo); ok {
+				return info.RetryDelay.AsDuration()
+			}
+		}
+		t.Fatal("no RetryInfo in", err)
+		return 0
+	}
+
+	t.Run("records per second by role", func(t *testing.T) {
+		client, _, _, teardown := setupTest(t, func(c *Config) {
+			c.RateLimits = &RateLimits{
+				Default: Limit{RecordsPerSecond: 0.1, RecordBurst: 1},
+				// root is a producer in the default policy.
+				Roles: map[string]Limit{"producers": {RecordsPerSecond: 0.1, RecordBurst: 3}},
+			}
+		})
+		defer teardown()
+		for i := 0; i < 3; i++ {
+			require.NoError(t, produce(client, "hello"))
+		}
+		require.Greater(t, retryAfter(produce(client, "hello")), time.Second)
+	})
+
+	t.Run("bytes per second by subject", func(t *testing.T) {
+		client, _, _, teardown := setupTest(t, func(c *Config) {
+			c.RateLimits = &RateLimits{
+				Default:  Limit{RecordsPerSecond: 0.1, RecordBurst: 1},
+				Subjects: map[string]Limit{"root": {BytesPerSecond: 1, ByteBurst: 10}},
+			}
+		})
+		defer teardown()
+		require.NoError(t, produce(client, "0123456"))
+		retryAfter(produce(client, "0123456"))
+		require.NoError(t, produce(client, "012"))
+		// Larger than the burst, so it would never fit.
+		err := produce(client, "0123456789a")
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		client, _, _, teardown := setupTest(t, func(c *Config) {
+			c.RateLimits = &RateLimits{Default: Limit{RecordsPerSecond: 0.1, RecordBurst: 2}}
+		})
+		defer teardown()
+		stream, err := client.ProduceStream(ctx)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, stream.Send(&api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello")},
+			}))
+		}
+		for i := 0; i < 2; i++ {
+			_, err := stream.Recv()
+			require.NoError(t, err)
+		}
+		_, err = stream.Recv()
+		retryAfter(err)
+	})
+
+	t.Run("pipelined stream", func(t *testing.T) {
+		client, _, _, teardown := setupTest(t, func(c *Config) {
+			c.MaxInFlight = 4
+			c.RateLimits = &RateLimits{Default: Limit{RecordsPerSecond: 0.1, RecordBurst: 2}}
+		})
+		defer teardown()
+		stream, err := client.ProduceStream(ctx)
+		require.NoError(t, err)
+		for i := 0; i < 4; i++ {
+			require.NoError(t, stream.Send(&api.ProduceRequest{
+				Record:        &api.Record{Value: []byte("hello")},
+				CorrelationId: uint64(i),
+			}))
+		}
+		require.NoError(t, stream.CloseSend())
+		// The stream carries on past the throttled records.
+		for i := 0; i < 4; i++ {
+			res, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), res.CorrelationId)
+			if i < 2 {
+				require.Nil(t, res.Error)
+			} else {
+				require.Equal(t, uint32(codes.ResourceExhausted), res.Error.GetCode())
+			}
+		}
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+}
+
+// END: ratelimit
+
+// START: quota
+func TestQuotas(t *testing.T) {
+	ctx := context.Background()
+	quotas := &ProduceQuotas{Default: 1, Subjects: map[string]uint64{"root": 10}}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.ProduceQuotas = quotas
+	})
+	defer teardown()
+	produce := func(value string) error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		return err
+	}
+
+	require.NoError(t, produce("012345"))
+	err := produce("012345")
+	st := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	violation := st.Details()[0].(*errdetails.QuotaFailure).Violations[0]
+	require.Equal(t, "root", violation.Subject)
+	require.NoError(t, produce("0123"))
+	require.Equal(t, uint64(10), quotas.Usage("root"))
+}
+
+func TestQuotaUsageFile(t *testing.T) {
+	usageFile := filepath.Join(t.TempDir(), "usage.json")
+	quotas := &ProduceQuotas{Default: 10, UsageFile: usageFile}
+	root := auth.Identity{Subject: "root"}
+	noRoles := func() []string { return nil }
+	for i := 0; i < 3; i++ {
+		require.NoError(t, quotas.reserve(root, noRoles, 3))
+	}
+	require.NoError(t, quotas.Flush())
+
+	// A restarted server carries on from the saved usage.
+	restarted := &ProduceQuotas{Default: 10, UsageFile: usageFile}
+	require.Equal(t, uint64(9), restarted.Usage("root"))
+	require.IsType(t, ErrQuotaExceeded{}, restarted.reserve(root, noRoles, 2))
+	require.NoError(t, restarted.reserve(root, noRoles, 1))
+}
+
+// END: quota
+
+// START: validation
+func TestValidation(t *testing.T) {
+	ctx := context.Background()
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxRecordBytes = 16
+		c.MaxMessageBytes = 1024
+	})
+	defer teardown()
+	fieldViolation := func(err error) string {
+		t.Helper()
+		st := status.Convert(err)
+		require.Equal(t, codes.InvalidArgument, st.Code(), err)
+		require.Len(t, st.Details(), 1)
+		violations := st.Details()[0].(*errdetails.BadRequest).FieldViolations
+		require.Len(t, violations, 1)
+		return violations[0].Field
+	}
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, "record", fieldViolation(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: bytes.Repeat([]byte("a"), 20)},
+	})
+	require.Equal(t, "record", fieldViolation(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: bytes.Repeat([]byte("a"), 2048)},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Streams validate every record too.
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{}))
+	_, err = stream.Recv()
+	require.Equal(t, "record", fieldViolation(err))
+
+	res, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+}
+
+// END: validation
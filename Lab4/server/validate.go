@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+
+	api "Proyecto/api/v1"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// validate checks a ProduceRequest before it reaches the log.
+func (s *grpcServer) validate(req *api.ProduceRequest) error {
+	if req.GetRecord() == nil {
+		return invalidArgument(&errdetails.BadRequest_FieldViolation{
+			Field:       "record",
+			Description: "record is required",
+		})
+	}
+	if s.MaxRecordBytes > 0 {
+		if size := proto.Size(req.Record); size > s.MaxRecordBytes {
+			return invalidArgument(&errdetails.BadRequest_FieldViolation{
+				Field: "record",
+				Description: fmt.Sprintf(
+					"record is %d bytes, more than the limit of %d",
+					size, s.MaxRecordBytes,
+				),
+			})
+		}
+	}
+	return nil
+}
+
+func invalidArgument(violations ...*errdetails.BadRequest_FieldViolation) error {
+	st := status.New(codes.InvalidArgument, violations[0].Description)
+	std, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return std.Err()
+}
@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+
+	api "Proyecto/api/v1"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const InstrumentationName = "Proyecto"
+
+// Propagator is used both for gRPC metadata and for record headers.
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// NewTracerProvider exports spans over OTLP/gRPC to endpoint.
+func NewTracerProvider(ctx context.Context, service, endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracegrpc.New(ctx,
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(service),
+		)),
+	), nil
+}
+
+// RecordCarrier lets trace context travel inside a record's headers so
+// it is stored in the log along with the value.
+type RecordCarrier struct {
+	Record *api.Record
+}
+
+var _ propagation.TextMapCarrier = RecordCarrier{}
+
+func (c RecordCarrier) Get(key string) string {
+	return c.Record.GetHeaders()[key]
+}
+
+func (c RecordCarrier) Set(key, value string) {
+	if c.Record.Headers == nil {
+		c.Record.Headers = make(map[string]string)
+	}
+	c.Record.Headers[key] = value
+}
+
+func (c RecordCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.Record.GetHeaders()))
+	for k := range c.Record.GetHeaders() {
+		keys = append(keys, k)
+	}
+	return keys
+}